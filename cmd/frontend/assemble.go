@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tuananh/apkbuild/pkg/apk"
+	"github.com/tuananh/apkbuild/pkg/apkindex"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// signFlags are the signing flags shared by assemble and index.
+type signFlags struct {
+	keyFile string
+	keyName string
+	sigType string
+}
+
+func (s *signFlags) register(fset *flag.FlagSet) {
+	fset.StringVar(&s.keyFile, "sign-key", "", "PEM RSA private key `file` to sign with")
+	fset.StringVar(&s.keyName, "key-name", "", "public key `name` the signature is for (e.g. builder-5e69ca50.rsa.pub)")
+	fset.StringVar(&s.sigType, "signature-type", "", "signature `type`: RSA (SHA1, default) or RSA256")
+}
+
+// signer returns the signer for the flags, or nil when -sign-key is not set.
+func (s *signFlags) signer() (apk.Signer, error) {
+	if s.keyFile == "" {
+		return nil, nil
+	}
+	if s.keyName == "" {
+		return nil, fmt.Errorf("-sign-key requires -key-name")
+	}
+	data, err := os.ReadFile(s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return apk.NewRSASigner(s.keyName, data)
+}
+
+// runAssemble packs a directory into an .apk. The frontend runs it in an LLB exec (with the
+// frontend image as the helper) when assembly happens inside the build.
+func runAssemble(args []string) int {
+	fset := flag.NewFlagSet("assemble", flag.ContinueOnError)
+	specFile := fset.String("spec", "", "package spec `file`, as resolved by the frontend for this package")
+	out := fset.String("o", "", "output `file`")
+	arch := fset.String("arch", "", "package `arch` (default: noarch when the spec says so, else from the ELF files; required for packages without any)")
+	subdir := fset.String("prefer-subdir", "", "assemble DIR/`NAME` instead of DIR when it is a directory")
+	verify := fset.Bool("verify", false, "verify the package after writing it")
+	var verifyKeys stringsFlag
+	fset.Var(&verifyKeys, "verify-key", "trusted public key `file` for -verify (repeatable; none: signature not checked)")
+	var sign signFlags
+	sign.register(fset)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: apkbuild assemble -spec FILE -o FILE.apk [flags] DIR")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 || *specFile == "" || *out == "" {
+		fset.Usage()
+		return 2
+	}
+	if err := assemble(fset.Arg(0), *specFile, *out, *arch, *subdir, &sign); err != nil {
+		fmt.Fprintln(os.Stderr, "apkbuild assemble:", err)
+		return 1
+	}
+	if *verify {
+		keys, err := loadKeys("", verifyKeys)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "apkbuild assemble:", err)
+			return 1
+		}
+		if _, err := verifyFile(*out, apk.VerifyOptions{Keys: keys, AllowUntrusted: len(keys) == 0}); err != nil {
+			fmt.Fprintf(os.Stderr, "apkbuild assemble: verify %s: %v\n", *out, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func assemble(dir, specFile, out, arch, subdir string, sign *signFlags) error {
+	data, err := os.ReadFile(specFile)
+	if err != nil {
+		return err
+	}
+	s, err := spec.Load(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", specFile, err)
+	}
+	if subdir != "" {
+		if info, err := os.Stat(filepath.Join(dir, subdir)); err == nil && info.IsDir() {
+			dir = filepath.Join(dir, subdir)
+		}
+	}
+	signer, err := sign.signer()
+	if err != nil {
+		return err
+	}
+	opts := apk.AssembleOptions{
+		Format:        s.Package.Format,
+		Signer:        signer,
+		SignatureType: sign.sigType,
+		Arch:          apk.PackageArch(s, arch),
+	}
+	if s.Build.SourceDateEpoch != nil {
+		epoch := time.Unix(*s.Build.SourceDateEpoch, 0).UTC()
+		opts.SourceDateEpoch = &epoch
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return err
+	}
+	return apk.AssembleAPK(dir, out, s, opts)
+}
+
+// runIndex writes APKINDEX.tar.gz for the packages in a directory.
+func runIndex(args []string) int {
+	fset := flag.NewFlagSet("index", flag.ContinueOnError)
+	description := fset.String("description", "", "index `description` (e.g. \"v1.2 main\")")
+	var sign signFlags
+	sign.register(fset)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: apkbuild index [-description TEXT] [-sign-key FILE -key-name NAME] DIR")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+	signer, err := sign.signer()
+	if err == nil {
+		err = apkindex.WriteDir(fset.Arg(0), apkindex.Options{
+			Description:   *description,
+			Signer:        signer,
+			SignatureType: sign.sigType,
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apkbuild index:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a CLI subcommand. run returns the process exit code.
+type command struct {
+	summary string
+	run     func(args []string) int
+}
+
+var commands = map[string]command{
+	"assemble": {"pack a directory into an .apk (used for in-build assembly)", runAssemble},
+	"index":    {"write APKINDEX.tar.gz for the .apk files in a directory", runIndex},
+	"inspect":  {"print the metadata and file list of an .apk", runInspect},
+	"verify":   {"check the signature, datahash and file checksums of .apk files", runVerify},
+}
+
+// runCommand dispatches args[0] to a subcommand and returns the exit code.
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(os.Stderr, "apkbuild: unknown command %q\n\n", args[0])
+		}
+		usage()
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage: apkbuild <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\nWithout a command the binary runs as a BuildKit frontend.")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tuananh/apkbuild/pkg/apk"
+)
+
+func runInspect(args []string) int {
+	fset := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fset.Bool("json", false, "print as JSON")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: apkbuild inspect [-json] FILE.apk")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fset.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apkbuild inspect:", err)
+		return 1
+	}
+	defer f.Close()
+	pkg, err := apk.ReadAPK(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apkbuild inspect: %s: %v\n", fset.Arg(0), err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(pkg); err != nil {
+			fmt.Fprintln(os.Stderr, "apkbuild inspect:", err)
+			return 1
+		}
+		return 0
+	}
+	printPackage(os.Stdout, pkg)
+	return 0
+}
+
+// printPackage writes pkg in a human-readable form: signatures, .PKGINFO, scripts and an
+// ls -l style file list.
+func printPackage(w io.Writer, pkg *apk.Package) {
+	if len(pkg.Signatures) == 0 {
+		fmt.Fprintln(w, "signature: none")
+	}
+	for _, s := range pkg.Signatures {
+		fmt.Fprintf(w, "signature: %s %s\n", s.Type, s.KeyName)
+	}
+	sum, _ := hex.DecodeString(pkg.ControlChecksum)
+	fmt.Fprintf(w, "checksum: Q1%s\n", base64.StdEncoding.EncodeToString(sum))
+	if err := pkg.VerifyDataHash(); err != nil {
+		fmt.Fprintf(w, "datahash: %v\n", err)
+	} else {
+		fmt.Fprintln(w, "datahash: ok")
+	}
+
+	fmt.Fprintln(w, "\n.PKGINFO:")
+	w.Write(pkg.PKGInfo.Bytes())
+
+	if len(pkg.Scripts) > 0 {
+		names := make([]string, 0, len(pkg.Scripts))
+		for name := range pkg.Scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "\n%s:\n%s", name, pkg.Scripts[name])
+		}
+	}
+
+	fmt.Fprintln(w, "\nfiles:")
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for _, f := range pkg.Files {
+		name := f.Name
+		switch f.Type {
+		case "symlink":
+			name += " -> " + f.Linkname
+		case "hardlink":
+			name += " link to " + f.Linkname
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t%d\t%s\t%s\n", fileModeString(f), owner(f.Uname, f.Uid), owner(f.Gname, f.Gid),
+			f.Size, time.Unix(f.ModTime, 0).UTC().Format("2006-01-02 15:04"), name)
+	}
+	tw.Flush()
+}
+
+// fileModeString renders f's type and permissions like ls -l (drwxr-xr-x).
+func fileModeString(f apk.File) string {
+	m := fs.FileMode(f.Mode & 0o777)
+	if f.Mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if f.Mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if f.Mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	switch f.Type {
+	case "dir":
+		m |= fs.ModeDir
+	case "symlink":
+		m |= fs.ModeSymlink
+	case "char":
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case "block":
+		m |= fs.ModeDevice
+	case "fifo":
+		m |= fs.ModeNamedPipe
+	}
+	return m.String()
+}
+
+func owner(name string, id int) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprint(id)
+}
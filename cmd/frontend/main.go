@@ -9,6 +9,10 @@ import (
 )
 
 func main() {
+	// With arguments the binary is a CLI (apkbuild inspect ...); BuildKit runs it without any.
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	ctx := appcontext.Context()
 	if err := grpcclient.RunFromEnvironment(ctx, frontend.BuildFunc); err != nil {
 		os.Exit(1)
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/apk"
+)
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+func runVerify(args []string) int {
+	fset := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var keyFiles stringsFlag
+	fset.Var(&keyFiles, "key", "trusted public key `file` (repeatable)")
+	keysDir := fset.String("keys-dir", "/etc/apk/keys", "`directory` of trusted *.rsa.pub keys (ignored if missing)")
+	allowUntrusted := fset.Bool("allow-untrusted", false, "skip the signature check")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: apkbuild verify [-key FILE]... [-keys-dir DIR] [-allow-untrusted] FILE.apk...")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return 2
+	}
+
+	keys, err := loadKeys(*keysDir, keyFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apkbuild verify:", err)
+		return 1
+	}
+
+	status := 0
+	for _, name := range fset.Args() {
+		keyName, err := verifyFile(name, apk.VerifyOptions{Keys: keys, AllowUntrusted: *allowUntrusted})
+		var verr *apk.VerifyError
+		switch {
+		case errors.As(err, &verr):
+			fmt.Printf("%s: FAILED\n", name)
+			for _, p := range verr.Problems {
+				fmt.Printf("  %v\n", p)
+			}
+			status = 1
+		case err != nil:
+			fmt.Printf("%s: ERROR: %v\n", name, err)
+			status = 1
+		case keyName != "":
+			fmt.Printf("%s: OK (signed by %s)\n", name, keyName)
+		default:
+			fmt.Printf("%s: OK (signature not checked)\n", name)
+		}
+	}
+	return status
+}
+
+func verifyFile(name string, opts apk.VerifyOptions) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, keyName, err := apk.Verify(f, opts)
+	return keyName, err
+}
+
+// loadKeys reads the *.pub keys in dir (if it exists) and the given key files, indexed by file
+// name as apk-tools matches them against .SIGN.<type>.<keyname>. An empty dir reads only files.
+func loadKeys(dir string, files []string) (map[string]*rsa.PublicKey, error) {
+	var paths []string
+	if dir != "" {
+		var err error
+		if paths, err = filepath.Glob(filepath.Join(dir, "*.pub")); err != nil {
+			return nil, err
+		}
+	}
+	paths = append(paths, files...)
+	keys := make(map[string]*rsa.PublicKey, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		key, err := apk.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		keys[filepath.Base(p)] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,171 @@
+package frontend
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+	"github.com/tuananh/apkbuild/pkg/apk"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const (
+	// buildArgAssemble selects where packages are assembled: assembleInBuild (default) runs
+	// `apkbuild assemble` as an LLB exec, so assembly is cached by BuildKit, runs in parallel for
+	// subpackages and the output size is not limited; assembleInFrontend reads the solved build
+	// result from the frontend process and passes the packages back inside the LLB definition.
+	buildArgAssemble = "APK_ASSEMBLE"
+	// buildArgAssemblerImage overrides the image that runs `apkbuild assemble` (default: the
+	// frontend image, from the gateway's source option).
+	buildArgAssemblerImage = "APK_ASSEMBLER_IMAGE"
+
+	assembleInFrontend = "frontend"
+	assembleInBuild    = "build"
+
+	// assemblerBinary is the apkbuild binary in the frontend image (see Dockerfile).
+	assemblerBinary = "/frontend"
+	// nestedDataDir is used instead of ${{targets.outdir}} for the main package when the pipeline
+	// left a directory of that name in it (same as the previous shell behavior).
+	nestedDataDir = "build-out"
+)
+
+// pkgDir is a package to assemble and its directory in the build result.
+type pkgDir struct {
+	spec *specpkg.Spec
+	dir  string
+	// nested: assemble dir/nestedDataDir instead when it is a directory.
+	nested bool
+}
+
+// assembleMode returns the APK_ASSEMBLE mode, assembleInBuild by default. Assembling in the
+// build needs an assembler image (see assemblerImage); without one this is an error rather than
+// a fallback to assembleInFrontend, whose output is limited by the size of the LLB definition.
+func assembleMode(client gwclient.Client, buildArgs map[string]string) (string, error) {
+	switch m := buildArgs[buildArgAssemble]; m {
+	case assembleInFrontend:
+		return assembleInFrontend, nil
+	case "", assembleInBuild:
+		if assemblerImage(client, buildArgs) == "" {
+			return "", errors.Errorf("cannot tell the frontend image to assemble packages with: set %s, or %s=%s to assemble in the frontend (outputs up to 16 MiB)", buildArgAssemblerImage, buildArgAssemble, assembleInFrontend)
+		}
+		return assembleInBuild, nil
+	default:
+		return "", errors.Errorf("%s: unknown mode %q (use %s or %s)", buildArgAssemble, m, assembleInFrontend, assembleInBuild)
+	}
+}
+
+// inBuildAssembler assembles packages with LLB execs of `apkbuild assemble` in the assembler
+// image, mounting the build result read-only at /build.
+type inBuildAssembler struct {
+	image     string
+	build     llb.State
+	context   llb.State // build context, for APK_VERIFY_KEYS
+	arch      string    // build platform arch: the <arch>/ directory of the repository
+	buildArgs map[string]string
+	opts      []llb.ConstraintsOpt
+}
+
+// newInBuildAssembler returns an assembler for the build result st.
+func newInBuildAssembler(client gwclient.Client, buildArgs map[string]string, st, bctx llb.State, arch string, opts ...llb.ConstraintsOpt) (*inBuildAssembler, error) {
+	image := assemblerImage(client, buildArgs)
+	if image == "" {
+		return nil, errors.Errorf("%s=%s: cannot tell the frontend image, set %s", buildArgAssemble, assembleInBuild, buildArgAssemblerImage)
+	}
+	return &inBuildAssembler{image: image, build: st, context: bctx, arch: arch, buildArgs: buildArgs, opts: opts}, nil
+}
+
+// assemblerImage returns APK_ASSEMBLER_IMAGE, or the frontend image from the gateway's source
+// option, or "" when neither is known.
+func assemblerImage(client gwclient.Client, buildArgs map[string]string) string {
+	if image := buildArgs[buildArgAssemblerImage]; image != "" {
+		return image
+	}
+	return client.BuildOpts().Opts["source"]
+}
+
+// signArgs returns the `apkbuild assemble`/`index` signing flags and run options: the key is
+// mounted from the signing secret, as for secretSigner.
+func (a *inBuildAssembler) signArgs() ([]string, []llb.RunOption) {
+	name := a.buildArgs[buildArgSigningKeyName]
+	if name == "" {
+		return nil, nil
+	}
+	args := []string{"-sign-key", secretKeyPath, "-key-name", apk.NormalizeKeyName(name)}
+	if t := a.buildArgs[buildArgSignatureType]; t != "" {
+		args = append(args, "-signature-type", t)
+	}
+	return args, []llb.RunOption{
+		llb.AddSecret(secretKeyPath, llb.SecretID(signingKeySecretID)),
+		// The secret is not part of the cache key; never reuse a result made with another key.
+		llb.IgnoreCache,
+	}
+}
+
+// run runs the assembler binary with args; the /out mount starts from out and is returned.
+func (a *inBuildAssembler) run(args []string, out llb.State, name string, extra ...llb.RunOption) llb.State {
+	runOpts := []llb.RunOption{
+		llb.Args(append([]string{assemblerBinary}, args...)),
+		llb.Network(llb.NetModeNone),
+		llb.WithCustomName(name),
+	}
+	runOpts = append(runOpts, extra...)
+	for _, o := range a.opts {
+		runOpts = append(runOpts, o)
+	}
+	return llb.Image(a.image).Run(runOpts...).AddMount("/out", out)
+}
+
+// Assemble returns a state with one package per pkgs entry under /<arch>/, and
+// APKINDEX.tar.gz when index is set.
+func (a *inBuildAssembler) Assemble(pkgs []pkgDir, index bool) (llb.State, error) {
+	signArgs, signOpts := a.signArgs()
+	verify, keyPaths, err := verifyKeyPaths(a.buildArgs, signArgs != nil)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	outputs := make([]llb.State, 0, len(pkgs))
+	for _, p := range pkgs {
+		data, err := yaml.Marshal(p.spec)
+		if err != nil {
+			return llb.State{}, errors.Wrapf(err, "marshal spec %s", p.spec.Name)
+		}
+		apkName := fmt.Sprintf("%s-%s-r%d.apk", strings.ToLower(p.spec.Name), p.spec.Version, p.spec.Epoch)
+		args := []string{
+			"assemble",
+			"-spec", "/in/spec.yml",
+			"-arch", apk.PackageArch(p.spec, a.arch),
+			"-o", path.Join("/out", a.arch, apkName),
+		}
+		if p.nested {
+			args = append(args, "-prefer-subdir", nestedDataDir)
+		}
+		args = append(args, signArgs...)
+		runOpts := []llb.RunOption{
+			llb.AddMount("/build", a.build, llb.Readonly),
+			llb.AddMount("/in", llb.Scratch().File(llb.Mkfile("/spec.yml", 0o644, data)), llb.Readonly),
+		}
+		runOpts = append(runOpts, signOpts...)
+		if verify {
+			args = append(args, "-verify")
+			for _, k := range keyPaths {
+				args = append(args, "-verify-key", path.Join("/context", k))
+			}
+			runOpts = append(runOpts, llb.AddMount("/context", a.context, llb.Readonly))
+		}
+		args = append(args, path.Join("/build", p.dir))
+		outputs = append(outputs, a.run(args, llb.Scratch(), "assemble "+apkName, runOpts...))
+	}
+	repo := llb.Merge(outputs, llb.WithCustomName("merge "+a.arch+" packages"))
+
+	if index {
+		args := []string{"index", "-description", a.buildArgs[buildArgIndexDescription]}
+		args = append(args, signArgs...)
+		repo = a.run(append(args, path.Join("/out", a.arch)), repo, "write APKINDEX", signOpts...)
+	}
+	return repo, nil
+}
@@ -0,0 +1,99 @@
+package frontend
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/tuananh/apkbuild/pkg/apk"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// optsClient is a gateway client with only BuildOpts.
+type optsClient struct {
+	gwclient.Client
+	opts map[string]string
+}
+
+func (c optsClient) BuildOpts() gwclient.BuildOpts { return gwclient.BuildOpts{Opts: c.opts} }
+
+func TestAssembleMode(t *testing.T) {
+	withSource := optsClient{opts: map[string]string{"source": "example.com/apkbuild:latest"}}
+	noSource := optsClient{opts: map[string]string{}}
+	for _, tt := range []struct {
+		name      string
+		client    gwclient.Client
+		buildArgs map[string]string
+		want      string // "" for an error
+	}{
+		{"default", withSource, nil, assembleInBuild},
+		{"default without image", noSource, nil, ""},
+		{"assembler image", noSource, map[string]string{buildArgAssemblerImage: "example.com/apkbuild:dev"}, assembleInBuild},
+		{"build without image", noSource, map[string]string{buildArgAssemble: assembleInBuild}, ""},
+		{"frontend", noSource, map[string]string{buildArgAssemble: assembleInFrontend}, assembleInFrontend},
+		{"unknown", withSource, map[string]string{buildArgAssemble: "elsewhere"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := assembleMode(tt.client, tt.buildArgs)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("mode %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("mode %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInBuildAssemble(t *testing.T) {
+	client := optsClient{opts: map[string]string{"source": "example.com/apkbuild:latest"}}
+	s := &specpkg.Spec{Name: "Hello", Version: "1.0", Epoch: 2, Subpackages: []specpkg.Subpackage{{Name: "hello-doc", Arch: apk.ArchNoarch}}}
+	pkgs := []pkgDir{
+		{spec: s, dir: apk.TargetsOutdir, nested: true},
+		{spec: apk.SubpackageSpec(s, s.Subpackages[0]), dir: apk.SubpackageDir("hello-doc")},
+	}
+	a, err := newInBuildAssembler(client, map[string]string{}, llb.Scratch(), llb.Scratch(), "aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := a.Assemble(pkgs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := st.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []string
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatal(err)
+		}
+		if e := op.GetExec(); e != nil {
+			if e.Network != pb.NetMode_NONE {
+				t.Errorf("%q runs with network", e.Meta.Args)
+			}
+			runs = append(runs, strings.Join(e.Meta.Args, " "))
+		}
+	}
+	slices.Sort(runs)
+	want := []string{
+		assemblerBinary + " assemble -spec /in/spec.yml -arch aarch64 -o /out/aarch64/hello-1.0-r2.apk -prefer-subdir " + nestedDataDir + " /build" + apk.TargetsOutdir,
+		assemblerBinary + " assemble -spec /in/spec.yml -arch noarch -o /out/aarch64/hello-doc-1.0-r2.apk /build" + apk.SubpackageDir("hello-doc"),
+		assemblerBinary + " index -description  /out/aarch64",
+	}
+	if !slices.Equal(runs, want) {
+		t.Errorf("runs:\n%s\nwant:\n%s", strings.Join(runs, "\n"), strings.Join(want, "\n"))
+	}
+}
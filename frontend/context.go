@@ -0,0 +1,39 @@
+package frontend
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+)
+
+// stateFileReader returns a function that reads files from st. The state is solved on the
+// first read only, so specs that never reference a file do not pay for an extra solve. The
+// function is safe for concurrent use (platforms are built in parallel).
+func stateFileReader(ctx context.Context, client gwclient.Client, st llb.State) func(string) ([]byte, error) {
+	var (
+		mu  sync.Mutex
+		ref gwclient.Reference
+	)
+	return func(p string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ref == nil {
+			def, err := st.Marshal(ctx)
+			if err != nil {
+				return nil, errors.Wrap(err, "marshal context llb")
+			}
+			res, err := client.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+			if err != nil {
+				return nil, err
+			}
+			if ref, err = res.SingleRef(); err != nil {
+				return nil, err
+			}
+		}
+		return ref.ReadFile(ctx, gwclient.ReadRequest{Filename: path.Clean("/" + p)})
+	}
+}
@@ -0,0 +1,72 @@
+package frontend
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+)
+
+// fileClient is a gateway client whose solves return a ref holding files.
+type fileClient struct {
+	gwclient.Client
+	files map[string]string
+
+	mu     sync.Mutex
+	solves int
+}
+
+func (c *fileClient) Solve(ctx context.Context, req gwclient.SolveRequest) (*gwclient.Result, error) {
+	c.mu.Lock()
+	c.solves++
+	c.mu.Unlock()
+	res := gwclient.NewResult()
+	res.SetRef(fileRef{files: c.files})
+	return res, nil
+}
+
+// fileRef is a reference with only ReadFile.
+type fileRef struct {
+	gwclient.Reference
+	files map[string]string
+}
+
+func (r fileRef) ReadFile(ctx context.Context, req gwclient.ReadRequest) ([]byte, error) {
+	data, ok := r.files[req.Filename]
+	if !ok {
+		return nil, errors.Errorf("%s: not found", req.Filename)
+	}
+	return []byte(data), nil
+}
+
+func TestStateFileReader(t *testing.T) {
+	client := &fileClient{files: map[string]string{"/scripts/post-install": "echo hi\n"}}
+	read := stateFileReader(context.Background(), client, llb.Local("context"))
+	if client.solves != 0 {
+		t.Fatalf("context solved before any read")
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range []string{"scripts/post-install", "/scripts/post-install", "scripts/../scripts/post-install", "../scripts/post-install"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := read(p)
+			if err != nil {
+				t.Errorf("read %s: %v", p, err)
+			} else if string(data) != "echo hi\n" {
+				t.Errorf("read %s = %q", p, data)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := read("missing"); err == nil {
+		t.Error("read of a missing file succeeded")
+	}
+	if client.solves != 1 {
+		t.Errorf("context solved %d times, want once", client.solves)
+	}
+}
@@ -2,17 +2,34 @@ package frontend
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/dockerui"
 	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/tuananh/apkbuild/pkg/apk"
+	"github.com/tuananh/apkbuild/pkg/apkindex"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const (
+	// targetIndex (--target index) emits APKINDEX.tar.gz next to the packages.
+	targetIndex = "index"
+	// buildArgIndexDescription sets the APKINDEX DESCRIPTION (e.g. "v1.2 main").
+	buildArgIndexDescription = "APKINDEX_DESCRIPTION"
+	// buildArgFormat selects the package format (v2 or v3), overriding package.format.
+	buildArgFormat = "APK_FORMAT"
 )
 
 // BuildFunc is the BuildKit gateway BuildFunc that reads the YAML spec from the
@@ -34,6 +51,16 @@ func BuildFunc(ctx context.Context, client gwclient.Client) (*gwclient.Result, e
 		return nil, errors.Wrap(err, "parse spec yaml")
 	}
 
+	// SOURCE_DATE_EPOCH build arg (parsed by dockerui) takes precedence over the spec.
+	if dc.Epoch != nil {
+		epoch := dc.Epoch.Unix()
+		spec.Build.SourceDateEpoch = &epoch
+	}
+
+	if f := dc.BuildArgs[buildArgFormat]; f != "" {
+		spec.Package.Format = f
+	}
+
 	// Build context = main context (sources)
 	bctx, err := dc.MainContext(ctx)
 	if err != nil {
@@ -46,122 +73,314 @@ func BuildFunc(ctx context.Context, client gwclient.Client) (*gwclient.Result, e
 		buildOpts = append(buildOpts, llb.IgnoreCache)
 	}
 
-	// Build APK: produces state with built directory only (assembly is done in Go below)
-	st, err := apk.BuildAPK(ctx, spec, *bctx, nil, buildOpts...)
+	// Install scripts given by path come from the build context.
+	readContext := stateFileReader(ctx, client, *bctx)
+	if err := apk.ResolveScripts(spec, readContext); err != nil {
+		return nil, err
+	}
+
+	// --target index also writes <arch>/APKINDEX.tar.gz, signed with the same key as the packages.
+	index := dc.Target == targetIndex
+	if dc.Target != "" && !index {
+		return nil, errors.Errorf("unknown target %q (supported: %s)", dc.Target, targetIndex)
+	}
+	if index && spec.Package.Format == apk.FormatV3 {
+		return nil, errors.Errorf("--target %s supports v2 packages only", targetIndex)
+	}
+
+	mode, err := assembleMode(client, dc.BuildArgs)
 	if err != nil {
 		return nil, err
 	}
 
-	def, err := st.Marshal(ctx)
+	sources, err := resolveSources(ctx, client, spec, buildOpts...)
 	if err != nil {
-		return nil, errors.Wrap(err, "marshal llb")
+		return nil, err
 	}
 
-	// Solve: get ref to built directory
-	res, err := client.Solve(ctx, gwclient.SolveRequest{
-		Definition: def.ToPB(),
+	b := &platformBuilder{
+		client:      client,
+		dc:          dc,
+		spec:        spec,
+		bctx:        *bctx,
+		sources:     sources,
+		readContext: readContext,
+		mode:        mode,
+		index:       index,
+		opts:        buildOpts,
+	}
+
+	// Build once per --platform (in parallel), or for the worker's default platform. A
+	// multi-platform result has one ref per platform, each holding its <arch>/ directory.
+	rb, err := dc.Build(ctx, func(ctx context.Context, platform *ocispecs.Platform, idx int) (gwclient.Reference, *dockerspec.DockerOCIImage, *dockerspec.DockerOCIImage, error) {
+		p := dc.BuildPlatforms[0]
+		if platform != nil {
+			p = *platform
+		}
+		ref, err := b.build(ctx, p)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// dockerui records the platform of each ref from its image config.
+		return ref, &dockerspec.DockerOCIImage{Image: ocispecs.Image{Platform: p}}, nil, nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	return rb.Finalize()
+}
 
-	ref, err := res.SingleRef()
+// platformBuilder builds and assembles the packages of a spec for one platform at a time.
+type platformBuilder struct {
+	client      gwclient.Client
+	dc          *dockerui.Client
+	spec        *specpkg.Spec
+	bctx        llb.State
+	sources     map[string]llb.State // http sources by name, resolved for every platform
+	readContext func(string) ([]byte, error)
+	mode        string // assembleInFrontend or assembleInBuild
+	index       bool   // --target index
+	opts        []llb.ConstraintsOpt
+}
+
+// build runs the pipeline for platform p, in a worker image resolved for the platform it runs
+// on, and returns a ref holding the packages under <arch>/.
+func (b *platformBuilder) build(ctx context.Context, p ocispecs.Platform) (gwclient.Reference, error) {
+	client, dc, spec, buildOpts := b.client, b.dc, b.spec, b.opts
+
+	runOn, arch, err := buildPlatform(spec, p, dc.BuildPlatforms[0])
 	if err != nil {
 		return nil, err
 	}
+	platformArch := arch.Target
 
-	// Copy ref at apk.TargetsOutdir to a temp dir so we can run AssembleAPK in Go
-	tmpDir, err := os.MkdirTemp("", "apkbuild-ref-")
+	sources, err := contextSources(ctx, dc, spec, p)
 	if err != nil {
-		return nil, errors.Wrap(err, "mk temp dir")
+		return nil, err
 	}
-	defer os.RemoveAll(tmpDir)
+	maps.Copy(sources, b.sources)
 
-	if err := copyRefToDir(ctx, ref, apk.TargetsOutdir, tmpDir); err != nil {
-		return nil, errors.Wrap(err, "copy build-out from ref")
+	// Build APK: produces state with built directory only (assembly is done below)
+	platformOpts := append([]llb.ConstraintsOpt{llb.Platform(runOn)}, buildOpts...)
+	st, err := apk.BuildAPK(ctx, spec, b.bctx, sources, client, arch, platformOpts...)
+	if err != nil {
+		return nil, err
 	}
 
-	// Use nested build-out if present (same as previous shell behavior)
-	dataDir := tmpDir
-	if info, err := os.Stat(filepath.Join(tmpDir, "build-out")); err == nil && info.IsDir() {
-		dataDir = filepath.Join(tmpDir, "build-out")
+	// One APK for the main package, then one per subpackage from its ${{targets.subpkgdir}}.
+	pkgs := []pkgDir{{spec: spec, dir: apk.TargetsOutdir, nested: true}}
+	for _, sp := range spec.Subpackages {
+		pkgs = append(pkgs, pkgDir{spec: apk.SubpackageSpec(spec, sp), dir: apk.SubpackageDir(sp.Name)})
 	}
 
-	apkPath := filepath.Join(tmpDir, "out.apk")
-	if err := apk.AssembleAPK(dataDir, apkPath, spec); err != nil {
-		return nil, errors.Wrap(err, "assemble apk")
+	var out llb.State
+	if b.mode == assembleInBuild {
+		signed := dc.BuildArgs[buildArgSigningKeyName] != ""
+		if verify, _, err := verifyKeyPaths(dc.BuildArgs, signed); err != nil {
+			return nil, err
+		} else if verify && spec.Package.Format == apk.FormatV3 {
+			return nil, errors.Errorf("%s supports v2 packages only", buildArgVerify)
+		}
+		a, err := newInBuildAssembler(client, dc.BuildArgs, st, b.bctx, platformArch, buildOpts...)
+		if err != nil {
+			return nil, err
+		}
+		if out, err = a.Assemble(pkgs, b.index); err != nil {
+			return nil, err
+		}
+	} else {
+		tmpDir, err := os.MkdirTemp("", "apkbuild-repo-")
+		if err != nil {
+			return nil, errors.Wrap(err, "mk temp dir")
+		}
+		defer os.RemoveAll(tmpDir)
+		archDir := filepath.Join(tmpDir, platformArch)
+		epoch, err := assembleFromState(ctx, client, dc.BuildArgs, st, b.readContext, pkgs, platformArch, archDir, b.index, buildOpts...)
+		if err != nil {
+			return nil, err
+		}
+		// Write each file into scratch under <arch>/, the layout of an apk repository.
+		if out, err = repoState(archDir, platformArch, epoch); err != nil {
+			return nil, err
+		}
 	}
 
-	apkBytes, err := os.ReadFile(apkPath)
+	def, err := out.Marshal(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal write-apk llb")
+	}
+	res, err := client.Solve(ctx, gwclient.SolveRequest{
+		Definition: def.ToPB(),
+		Evaluate:   true,
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "read apk file")
+		return nil, withNetworkHint(err)
 	}
+	return res.SingleRef()
+}
 
-	apkName := fmt.Sprintf("%s-%s-r%d.apk", strings.ToLower(spec.Name), spec.Version, spec.Epoch)
-	b64 := base64.StdEncoding.EncodeToString(apkBytes)
+// buildPlatform returns the platform the pipeline for target platform p runs on and the arches
+// of the build. The package arch comes from p (unless noarch); the pipeline runs on p (emulated
+// if needed), or with build.cross on the build platform, cross-compiling for p.
+func buildPlatform(spec *specpkg.Spec, p, build ocispecs.Platform) (ocispecs.Platform, apk.BuildArch, error) {
+	target, err := apk.ArchFromPlatform(p)
+	if err != nil {
+		return ocispecs.Platform{}, apk.BuildArch{}, err
+	}
+	arch := apk.BuildArch{Build: target, Target: target}
+	if !spec.Build.Cross {
+		return p, arch, nil
+	}
+	if arch.Build, err = apk.ArchFromPlatform(build); err != nil {
+		return ocispecs.Platform{}, apk.BuildArch{}, err
+	}
+	if !arch.Cross() {
+		return p, arch, nil
+	}
+	return build, arch, nil
+}
 
-	// Second solve: run in an image that has sh+base64 (scratch has no shell), then copy apk to scratch
-	const writeAPKImage = "alpine:3.23"
-	written := llb.Image(writeAPKImage).Run(
-		llb.Args([]string{"sh", "-c", "mkdir -p /out && echo \"$APK_B64\" | base64 -d > \"/out/$APK_NAME\""}),
-		llb.AddEnv("APK_B64", b64),
-		llb.AddEnv("APK_NAME", apkName),
-		llb.WithCustomName("write apk"),
-	).Root()
-	writeAPK := llb.Scratch().File(llb.Copy(written, "/out/"+apkName, "/"))
+// withNetworkHint adds a hint to the error of a pipeline step that failed without network
+// access (apk.NoNetworkSuffix), as the errors tools report for it (e.g. "bad address") rarely
+// say that the network is disabled.
+func withNetworkHint(err error) error {
+	var se *errdefs.SolveError
+	if !errors.As(err, &se) || se.Op.GetExec().GetNetwork() != pb.NetMode_NONE ||
+		!strings.HasSuffix(se.Description["llb.customname"], apk.NoNetworkSuffix) {
+		return err
+	}
+	return errors.Wrap(err, "step ran without network access, set network: true on it if it needs to download anything")
+}
 
-	def2, err := writeAPK.Marshal(ctx)
+// assembleFromState solves st and assembles pkgs in the frontend process into the local
+// directory archDir, streaming the files from the solved reference (see refFS). It returns the
+// SOURCE_DATE_EPOCH the packages were made with, if any.
+func assembleFromState(ctx context.Context, client gwclient.Client, buildArgs map[string]string, st llb.State, readContext func(string) ([]byte, error), pkgs []pkgDir, platformArch, archDir string, index bool, buildOpts ...llb.ConstraintsOpt) (*time.Time, error) {
+	def, err := st.Marshal(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "marshal write-apk llb")
+		return nil, errors.Wrap(err, "marshal llb")
 	}
 
-	res2, err := client.Solve(ctx, gwclient.SolveRequest{
-		Definition: def2.ToPB(),
+	// Solve: get ref to built directory
+	res, err := client.Solve(ctx, gwclient.SolveRequest{
+		Definition: def.ToPB(),
 	})
+	if err != nil {
+		return nil, withNetworkHint(err)
+	}
+
+	ref, err := res.SingleRef()
 	if err != nil {
 		return nil, err
 	}
 
-	return res2, nil
-}
+	spec := pkgs[0].spec
+	assembleOpts := apk.AssembleOptions{
+		Format:        spec.Package.Format,
+		Signer:        newSecretSigner(ctx, client, buildArgs, buildOpts...),
+		SignatureType: buildArgs[buildArgSignatureType],
+	}
+	if spec.Build.SourceDateEpoch != nil {
+		epoch := time.Unix(*spec.Build.SourceDateEpoch, 0).UTC()
+		assembleOpts.SourceDateEpoch = &epoch
+	}
+	verifyOpts, err := verifyOptions(buildArgs, readContext, assembleOpts.Signer != nil)
+	if err != nil {
+		return nil, err
+	}
+	if verifyOpts != nil && assembleOpts.Format == apk.FormatV3 {
+		return nil, errors.Errorf("%s supports v2 packages only", buildArgVerify)
+	}
 
-// copyRefToDir recursively copies the ref at refPath into local dir destDir.
-func copyRefToDir(ctx context.Context, ref gwclient.Reference, refPath, destDir string) error {
-	entries, err := ref.ReadDir(ctx, gwclient.ReadDirRequest{Path: refPath})
+	// Hardlinks are matched by inode across each package tree, not only within one directory.
+	dirs := make([]string, len(pkgs))
+	for i, p := range pkgs {
+		dirs[i] = p.dir
+	}
+	inodes, err := listHardlinks(ctx, client, st, dirs, buildOpts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, e := range entries {
-		name := e.Path
-		if name == "" || name == "." || name == ".." {
-			continue
-		}
-		srcPath := refPath + "/" + name
-		dstPath := filepath.Join(destDir, filepath.FromSlash(name))
-		if e.Mode&uint32(os.ModeDir) != 0 {
-			if err := os.MkdirAll(dstPath, 0o755); err != nil {
-				return err
-			}
-			if err := copyRefToDir(ctx, ref, srcPath, dstPath); err != nil {
-				return err
+
+	// Assemble into a local repository tree: <arch>/<name>-<ver>-r<rel>.apk. noarch packages go
+	// in the build platform's directory, as in Alpine repositories.
+	if err := os.MkdirAll(archDir, 0o755); err != nil {
+		return nil, err
+	}
+	for _, p := range pkgs {
+		// Packages are assembled straight from the ref: each file is fetched once, through ranged
+		// reads, and never held whole in memory.
+		dir := p.dir
+		if p.nested {
+			if st, err := ref.StatFile(ctx, gwclient.StatRequest{Path: path.Join(dir, nestedDataDir)}); err == nil && os.FileMode(st.Mode).IsDir() {
+				dir = path.Join(dir, nestedDataDir)
 			}
-			continue
 		}
-		data, err := ref.ReadFile(ctx, gwclient.ReadRequest{Filename: srcPath})
-		if err != nil {
-			return err
+		opts := assembleOpts
+		opts.Arch = apk.PackageArch(p.spec, platformArch)
+		apkName := fmt.Sprintf("%s-%s-r%d.apk", strings.ToLower(p.spec.Name), p.spec.Version, p.spec.Epoch)
+		apkPath := filepath.Join(archDir, apkName)
+		if err := assembleFromRef(ctx, ref, dir, inodes, apkPath, p.spec, opts); err != nil {
+			return nil, errors.Wrapf(err, "assemble apk %s", p.spec.Name)
 		}
-		if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
-			return err
+		if verifyOpts != nil {
+			if err := verifyAPK(apkPath, *verifyOpts); err != nil {
+				return nil, errors.Wrapf(err, "verify %s", apkName)
+			}
 		}
-		// Preserve mode from ref (e.g. 0755 for binaries from make install)
-		mode := e.Mode & uint32(os.ModePerm)
-		if mode == 0 {
-			mode = 0o644
+	}
+
+	if index {
+		err := apkindex.WriteDir(archDir, apkindex.Options{
+			Description:   buildArgs[buildArgIndexDescription],
+			Signer:        assembleOpts.Signer,
+			SignatureType: assembleOpts.SignatureType,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "write APKINDEX")
 		}
-		if err := os.WriteFile(dstPath, data, os.FileMode(mode)); err != nil {
-			return err
+	}
+	return assembleOpts.SourceDateEpoch, nil
+}
+
+// repoState returns a scratch state holding the files of the local directory dir under
+// /<arch>/. The files are written with llb.Mkfile, so no image or exec is needed; mtimes are
+// set to epoch when given. Their content travels inside the LLB definition, which is why
+// assembleInBuild is the default.
+func repoState(dir, arch string, epoch *time.Time) (llb.State, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return llb.State{}, err
+	}
+	var (
+		dirOpts  = []llb.MkdirOption{llb.WithParents(true)}
+		fileOpts []llb.MkfileOption
+	)
+	if epoch != nil {
+		dirOpts = append(dirOpts, llb.WithCreatedTime(*epoch))
+		fileOpts = append(fileOpts, llb.WithCreatedTime(*epoch))
+	}
+	fa := llb.Mkdir("/"+arch, 0o755, dirOpts...)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return llb.State{}, errors.Wrap(err, "read output file")
 		}
+		fa = fa.Mkfile("/"+arch+"/"+f.Name(), 0o644, data, fileOpts...)
+	}
+	return llb.Scratch().File(fa, llb.WithCustomName("write "+arch+" packages")), nil
+}
+
+// assembleFromRef writes the package for the directory dir of ref to the local file outPath.
+// inodes identifies the hardlinked files in ref (see listHardlinks).
+func assembleFromRef(ctx context.Context, ref gwclient.Reference, dir string, inodes map[string]string, outPath string, s *specpkg.Spec, opts apk.AssembleOptions) error {
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	if err := apk.Assemble(out, newRefFS(ctx, ref, dir, inodes), s, opts); err != nil {
+		out.Close()
+		return err
 	}
-	return nil
+	return out.Close()
 }
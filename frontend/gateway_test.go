@@ -0,0 +1,132 @@
+package frontend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/tuananh/apkbuild/pkg/apk"
+	"github.com/tuananh/apkbuild/pkg/apkindex"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func TestWithNetworkHint(t *testing.T) {
+	stepErr := func(name string, network pb.NetMode) error {
+		return &errdefs.SolveError{
+			Err: errors.New("process did not complete successfully: exit code: 1"),
+			Solve: &errdefs.Solve{
+				Op:          &pb.Op{Op: &pb.Op_Exec{Exec: &pb.ExecOp{Network: network}}},
+				Description: map[string]string{"llb.customname": name},
+			},
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		err  error
+		hint bool
+	}{
+		{"offline step", stepErr("run: make"+apk.NoNetworkSuffix, pb.NetMode_NONE), true},
+		{"online step", stepErr("run: make", pb.NetMode_UNSET), false},
+		{"offline helper", stepErr("verify source hello sha512", pb.NetMode_NONE), false},
+		{"not a step", errors.New("marshal llb"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := withNetworkHint(tt.err)
+			if got := strings.Contains(err.Error(), "network: true"); got != tt.hint {
+				t.Errorf("hint in %q: %v, want %v", err, got, tt.hint)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%q does not wrap the solve error", err)
+			}
+		})
+	}
+}
+
+func TestBuildPlatform(t *testing.T) {
+	amd64 := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+	armv6 := ocispecs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+	armv7 := ocispecs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	mips := ocispecs.Platform{OS: "linux", Architecture: "mips64"}
+	for _, tt := range []struct {
+		name     string
+		cross    bool
+		p, build ocispecs.Platform
+		runOn    ocispecs.Platform
+		arch     apk.BuildArch // zero for an error
+	}{
+		{"native", false, amd64, amd64, amd64, apk.BuildArch{Build: "x86_64", Target: "x86_64"}},
+		{"emulated", false, arm64, amd64, arm64, apk.BuildArch{Build: "aarch64", Target: "aarch64"}},
+		{"armv6", false, armv6, amd64, armv6, apk.BuildArch{Build: "armhf", Target: "armhf"}},
+		{"armv7", false, armv7, amd64, armv7, apk.BuildArch{Build: "armv7", Target: "armv7"}},
+		{"cross", true, arm64, amd64, amd64, apk.BuildArch{Build: "x86_64", Target: "aarch64"}},
+		{"cross to the build platform", true, amd64, amd64, amd64, apk.BuildArch{Build: "x86_64", Target: "x86_64"}},
+		{"unsupported target", false, mips, amd64, ocispecs.Platform{}, apk.BuildArch{}},
+		{"unsupported build platform", true, arm64, mips, ocispecs.Platform{}, apk.BuildArch{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &specpkg.Spec{Build: specpkg.Build{Cross: tt.cross}}
+			runOn, arch, err := buildPlatform(s, tt.p, tt.build)
+			if tt.arch == (apk.BuildArch{}) {
+				if err == nil {
+					t.Fatalf("got %v, %+v; want an error", runOn, arch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runOn.Architecture != tt.runOn.Architecture || runOn.Variant != tt.runOn.Variant || arch != tt.arch {
+				t.Errorf("got %v, %+v; want %v, %+v", runOn, arch, tt.runOn, tt.arch)
+			}
+		})
+	}
+}
+
+func TestRepoState(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"hello-1.0-r0.apk", apkindex.FileName} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := time.Unix(1700000000, 0)
+	st, err := repoState(dir, "aarch64", &epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := st.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range op.GetFile().GetActions() {
+			switch {
+			case a.GetMkdir() != nil:
+				paths = append(paths, a.GetMkdir().Path+"/")
+			case a.GetMkfile() != nil:
+				f := a.GetMkfile()
+				if string(f.Data) != filepath.Base(f.Path) || f.Timestamp != epoch.UnixNano() {
+					t.Errorf("%s: data %q, timestamp %d", f.Path, f.Data, f.Timestamp)
+				}
+				paths = append(paths, f.Path)
+			}
+		}
+	}
+	want := "/aarch64/ /aarch64/" + apkindex.FileName + " /aarch64/hello-1.0-r0.apk"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("paths = %s, want %s", got, want)
+	}
+}
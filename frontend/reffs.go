@@ -0,0 +1,319 @@
+package frontend
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// refReadChunk is the size of the ranged ReadFile calls refFS reads files with; it bounds the
+// memory used per open file.
+const refReadChunk = 1 << 20
+
+// refFS exposes a directory of a solved BuildKit reference as an fs.FS, so packages are
+// assembled straight from the build result (see apk.Assemble) instead of being copied out first.
+// File contents are fetched in refReadChunk ranges. FileInfo.Sys returns a *tar.Header with the
+// owner, device numbers and, for the second and later names of a hardlinked file (see
+// listHardlinks), Typeflag TypeLink with the first name in walk order as Linkname.
+type refFS struct {
+	ctx   context.Context
+	ref   gwclient.Reference
+	root  string
+	links map[string]string // name -> first name of the same inode, relative to root
+}
+
+var (
+	_ fs.ReadDirFS   = (*refFS)(nil)
+	_ fs.StatFS      = (*refFS)(nil)
+	_ fs.ReadLinkFS  = (*refFS)(nil)
+	_ io.ReaderAt    = (*refFile)(nil)
+	_ io.ReadSeeker  = (*refFile)(nil)
+	_ fs.ReadDirFile = (*refFile)(nil)
+)
+
+// newRefFS returns the tree under root in ref. inodes maps absolute paths of hardlinked files in
+// ref to their "dev:ino" identity (see listHardlinks); entries outside root are ignored.
+func newRefFS(ctx context.Context, ref gwclient.Reference, root string, inodes map[string]string) *refFS {
+	byID := make(map[string][]string)
+	prefix := path.Clean(root) + "/"
+	for p, id := range inodes {
+		if name, ok := strings.CutPrefix(p, prefix); ok {
+			byID[id] = append(byID[id], name)
+		}
+	}
+	links := make(map[string]string)
+	for _, names := range byID {
+		// The first name fs.WalkDir reaches holds the content; the others link to it.
+		sort.Slice(names, func(i, j int) bool { return walkBefore(names[i], names[j]) })
+		for _, n := range names[1:] {
+			links[n] = names[0]
+		}
+	}
+	return &refFS{ctx: ctx, ref: ref, root: root, links: links}
+}
+
+// walkBefore reports whether fs.WalkDir visits a before b: names compare element by element.
+func walkBefore(a, b string) bool {
+	ae, be := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ae) && i < len(be); i++ {
+		if ae[i] != be[i] {
+			return ae[i] < be[i]
+		}
+	}
+	return len(ae) < len(be)
+}
+
+func (r *refFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(r.root, name), nil
+}
+
+// Stat implements fs.StatFS. Like StatFile, it does not follow symlinks.
+func (r *refFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := r.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := r.ref.StatFile(r.ctx, gwclient.StatRequest{Path: p})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return newRefFileInfo(path.Base(name), st, r.links[name]), nil
+}
+
+// Lstat implements fs.ReadLinkFS.
+func (r *refFS) Lstat(name string) (fs.FileInfo, error) { return r.Stat(name) }
+
+// ReadLink implements fs.ReadLinkFS.
+func (r *refFS) ReadLink(name string) (string, error) {
+	info, err := r.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return info.Sys().(*tar.Header).Linkname, nil
+}
+
+// ReadDir implements fs.ReadDirFS; entries are sorted by name.
+func (r *refFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := r.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := r.ref.ReadDir(r.ctx, gwclient.ReadDirRequest{Path: p})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(stats))
+	for _, st := range stats {
+		if st.Path == "" || st.Path == "." || st.Path == ".." {
+			continue
+		}
+		base := path.Base(st.Path)
+		entries = append(entries, fs.FileInfoToDirEntry(newRefFileInfo(base, st, r.links[path.Join(name, base)])))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Open implements fs.FS.
+func (r *refFS) Open(name string) (fs.File, error) {
+	info, err := r.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &refFile{fsys: r, name: name, info: info.(*refFileInfo)}, nil
+}
+
+// listHardlinks returns the "dev:ino" identity of every regular file with more than one link
+// under dirs in st, by absolute path. The gateway API reports no inodes, so the files are
+// listed with find and stat in an exec that mounts st read-only.
+func listHardlinks(ctx context.Context, client gwclient.Client, st llb.State, dirs []string, opts ...llb.ConstraintsOpt) (map[string]string, error) {
+	const script = `for d; do [ ! -d "$d" ] || find "$d" -type f -links +1 -exec stat -c '%d:%i %n' {} +; done > /out/links`
+	args := []string{"sh", "-c", script, "sh"}
+	for _, d := range dirs {
+		args = append(args, path.Join("/build", d))
+	}
+	runOpts := []llb.RunOption{
+		llb.Args(args),
+		llb.AddMount("/build", st, llb.Readonly),
+		llb.Network(llb.NetModeNone),
+		llb.WithCustomName("list hardlinks"),
+	}
+	for _, o := range opts {
+		runOpts = append(runOpts, o)
+	}
+	out := llb.Image(signImage).Run(runOpts...).AddMount("/out", llb.Scratch())
+	def, err := out.Marshal(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal hardlink llb")
+	}
+	res, err := client.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, errors.Wrap(err, "list hardlinks")
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ref.ReadFile(ctx, gwclient.ReadRequest{Filename: "/links"})
+	if err != nil {
+		return nil, errors.Wrap(err, "list hardlinks")
+	}
+	inodes := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if id, p, ok := strings.Cut(line, " "); ok {
+			inodes[strings.TrimPrefix(p, "/build")] = id
+		}
+	}
+	return inodes, nil
+}
+
+// refFileInfo implements fs.FileInfo for a fstypes.Stat.
+type refFileInfo struct {
+	name string
+	st   *fstypes.Stat
+	hdr  *tar.Header
+}
+
+func newRefFileInfo(name string, st *fstypes.Stat, hardlink string) *refFileInfo {
+	hdr := &tar.Header{
+		Uid:      int(st.Uid),
+		Gid:      int(st.Gid),
+		Linkname: st.Linkname,
+		Devmajor: st.Devmajor,
+		Devminor: st.Devminor,
+	}
+	if fs.FileMode(st.Mode)&fs.ModeSymlink == 0 {
+		// fsutil only sets Linkname on other files for hardlinks within one listing; links
+		// across the tree come from hardlink.
+		hdr.Linkname = ""
+	}
+	if hardlink != "" {
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = hardlink
+	}
+	return &refFileInfo{name: name, st: st, hdr: hdr}
+}
+
+func (i *refFileInfo) Name() string       { return i.name }
+func (i *refFileInfo) Size() int64        { return i.st.Size }
+func (i *refFileInfo) Mode() fs.FileMode  { return fs.FileMode(i.st.Mode) }
+func (i *refFileInfo) ModTime() time.Time { return time.Unix(0, i.st.ModTime) }
+func (i *refFileInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *refFileInfo) Sys() any           { return i.hdr }
+
+// refFile reads a file of a refFS sequentially through a refReadChunk buffer, or at offsets
+// with ReadAt (used for ELF headers).
+type refFile struct {
+	fsys *refFS
+	name string
+	info *refFileInfo
+	off  int64  // offset of the next Read
+	buf  []byte // data at off not yet returned by Read
+
+	dir    []fs.DirEntry // directory entries, once listed by ReadDir
+	dirOff int           // entries of dir already returned
+}
+
+func (f *refFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *refFile) Close() error               { return nil }
+
+func (f *refFile) Read(p []byte) (int, error) {
+	if len(f.buf) == 0 {
+		if f.off >= f.info.Size() {
+			return 0, io.EOF
+		}
+		buf, err := f.readRange(f.off, refReadChunk)
+		if err != nil {
+			return 0, err
+		}
+		f.buf = buf
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *refFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= f.info.Size() {
+			return n, io.EOF
+		}
+		b, err := f.readRange(off+int64(n), min(len(p)-n, refReadChunk))
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b)
+	}
+	return n, nil
+}
+
+func (f *refFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off, f.buf = offset, nil
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile. The directory is listed on the first call; later calls
+// continue where the previous one stopped.
+func (f *refFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.dir == nil {
+		entries, err := f.fsys.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.dir = entries
+	}
+	rest := f.dir[f.dirOff:]
+	if n <= 0 {
+		f.dirOff = len(f.dir)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	f.dirOff += n
+	return rest[:n], nil
+}
+
+// readRange returns up to length bytes at off; an empty read before the end of the file is an error.
+func (f *refFile) readRange(off int64, length int) ([]byte, error) {
+	p := path.Join(f.fsys.root, f.name)
+	b, err := f.fsys.ref.ReadFile(f.fsys.ctx, gwclient.ReadRequest{
+		Filename: p,
+		Range:    &gwclient.FileRange{Offset: int(off), Length: length},
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	if len(b) == 0 {
+		return nil, &fs.PathError{Op: "read", Path: f.name, Err: errors.Wrap(io.ErrUnexpectedEOF, "file shrank")}
+	}
+	return b, nil
+}
@@ -0,0 +1,131 @@
+package frontend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+	"github.com/tuananh/apkbuild/pkg/apk"
+)
+
+const (
+	// signingKeySecretID is the BuildKit secret holding the PEM RSA private key
+	// (docker buildx build --secret id=apk-signing-key,src=builder.rsa ...).
+	signingKeySecretID = "apk-signing-key"
+	// buildArgSigningKeyName enables signing and names the public key the package is signed for
+	// (as installed in /etc/apk/keys, e.g. builder-5e69ca50.rsa.pub).
+	buildArgSigningKeyName = "APK_SIGNING_KEY_NAME"
+	// buildArgSignatureType selects RSA (SHA1, default) or RSA256 signatures.
+	buildArgSignatureType = "APK_SIGNATURE_TYPE"
+
+	signImage = "alpine:3.23"
+)
+
+// secretSigner implements apk.Signer by running openssl in a BuildKit exec with the private key
+// mounted from a secret, so the key never reaches the frontend process or any snapshot.
+// Only the digest goes in and only the signature (or the public key) comes out.
+type secretSigner struct {
+	ctx    context.Context
+	client gwclient.Client
+	name   string
+	opts   []llb.ConstraintsOpt
+	pub    *rsa.PublicKey
+}
+
+// newSecretSigner returns a signer if APK_SIGNING_KEY_NAME is set, nil otherwise.
+func newSecretSigner(ctx context.Context, client gwclient.Client, buildArgs map[string]string, opts ...llb.ConstraintsOpt) apk.Signer {
+	name := buildArgs[buildArgSigningKeyName]
+	if name == "" {
+		return nil
+	}
+	return &secretSigner{ctx: ctx, client: client, name: apk.NormalizeKeyName(name), opts: opts}
+}
+
+// KeyName implements apk.Signer.
+func (s *secretSigner) KeyName() string { return s.name }
+
+// SignDigest implements apk.Signer.
+func (s *secretSigner) SignDigest(h crypto.Hash, digest []byte) ([]byte, error) {
+	var alg string
+	switch h {
+	case crypto.SHA1:
+		alg = "sha1"
+	case crypto.SHA256:
+		alg = "sha256"
+	case crypto.SHA512:
+		alg = "sha512"
+	default:
+		return nil, fmt.Errorf("unsupported digest %v", h)
+	}
+	script := fmt.Sprintf("openssl pkeyutl -sign -inkey %s -pkeyopt digest:%s -in /in/digest -out /out/result\n", secretKeyPath, alg)
+	in := llb.Scratch().File(llb.Mkfile("/digest", 0o644, digest), s.opts...)
+	return s.run(script, in, "sign apk ("+s.name+")")
+}
+
+// PublicKey implements apk.PublicKeySigner (v3 signatures carry a hash of the public key).
+// The key is derived from the secret once and cached.
+func (s *secretSigner) PublicKey() (*rsa.PublicKey, error) {
+	if s.pub != nil {
+		return s.pub, nil
+	}
+	script := fmt.Sprintf("openssl pkey -in %s -pubout -out /out/result\n", secretKeyPath)
+	data, err := s.run(script, llb.Scratch(), "public key ("+s.name+")")
+	if err != nil {
+		return nil, err
+	}
+	if s.pub, err = apk.ParsePublicKey(data); err != nil {
+		return nil, err
+	}
+	return s.pub, nil
+}
+
+const secretKeyPath = "/run/secrets/" + signingKeySecretID
+
+// opensslState returns signImage with openssl installed. The install does not depend on the key,
+// so BuildKit caches it; only the execs that mount the secret bypass the cache.
+func (s *secretSigner) opensslState() llb.State {
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"apk", "add", "--no-cache", "-q", "openssl"}),
+		llb.WithCustomName("install openssl"),
+	}
+	for _, o := range s.opts {
+		runOpts = append(runOpts, o)
+	}
+	return llb.Image(signImage).Run(runOpts...).Root()
+}
+
+// run executes script in opensslState with the private key mounted at secretKeyPath, in at /in,
+// and returns the content of /out/result. The exec has no network access.
+func (s *secretSigner) run(script string, in llb.State, name string) ([]byte, error) {
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"sh", "-c", "set -e\n" + script}),
+		llb.AddSecret(secretKeyPath, llb.SecretID(signingKeySecretID)),
+		llb.AddMount("/in", in, llb.Readonly),
+		llb.Network(llb.NetModeNone),
+		// The secret is not part of the cache key; never reuse a result made with another key.
+		llb.IgnoreCache,
+		llb.WithCustomName(name),
+	}
+	for _, o := range s.opts {
+		runOpts = append(runOpts, o)
+	}
+	out := s.opensslState().Run(runOpts...).AddMount("/out", llb.Scratch())
+
+	def, err := out.Marshal(s.ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal sign llb")
+	}
+	res, err := s.client.Solve(s.ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "sign with secret %q", signingKeySecretID)
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	return ref.ReadFile(s.ctx, gwclient.ReadRequest{Filename: "/result"})
+}
@@ -0,0 +1,107 @@
+package frontend
+
+import (
+	"context"
+	"sort"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerui"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/tuananh/apkbuild/pkg/apk"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// resolveSources returns the spec's http sources by name. Each download is solved here, once
+// for all platforms, so an unreachable URI or a checksum mismatch fails the build with the
+// source named before any pipeline container starts; BuildAPK then reuses the cached result.
+// Context sources depend on the platform and are loaded by contextSources.
+func resolveSources(ctx context.Context, client gwclient.Client, spec *specpkg.Spec, opts ...llb.ConstraintsOpt) (map[string]llb.State, error) {
+	if err := apk.ValidateSources(spec); err != nil {
+		return nil, err
+	}
+	sources := make(map[string]llb.State, len(spec.Sources))
+	for _, name := range sourceNames(spec) {
+		h := spec.Sources[name].HTTP
+		if h == nil {
+			continue
+		}
+		st := apk.HTTPSourceState(name, h)
+		def, err := st.Marshal(ctx, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal source %s", name)
+		}
+		if _, err := client.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB(), Evaluate: true}); err != nil {
+			return nil, errors.Wrapf(err, "source %s: fetch %s", name, h.URI)
+		}
+		sources[name] = st
+	}
+	return sources, nil
+}
+
+// contextSources returns the spec's context sources by name, loaded for the target platform p:
+// image contexts resolve to p's variant, and --build-context name::os/arch applies to p only.
+func contextSources(ctx context.Context, dc *dockerui.Client, spec *specpkg.Spec, p ocispecs.Platform) (map[string]llb.State, error) {
+	sources := make(map[string]llb.State, len(spec.Sources))
+	for _, name := range sourceNames(spec) {
+		c := spec.Sources[name].Context
+		if c == nil {
+			continue
+		}
+		st, err := namedContext(ctx, dc, name, c, p)
+		if err != nil {
+			return nil, err
+		}
+		sources[name] = st
+	}
+	return sources, nil
+}
+
+// sourceNames returns the names of the spec's sources, sorted.
+func sourceNames(spec *specpkg.Spec) []string {
+	names := make([]string, 0, len(spec.Sources))
+	for name := range spec.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namedContext loads the build context of the context source name (--build-context, by default
+// named after the source) for platform p. Local directories only transfer the files matching include/exclude.
+func namedContext(ctx context.Context, dc *dockerui.Client, name string, c *specpkg.SourceContext, p ocispecs.Platform) (llb.State, error) {
+	cname := c.Name
+	if cname == "" {
+		cname = name
+	}
+	nc, err := dc.NamedContext(cname, contextOpt(c, p))
+	if err != nil {
+		return llb.State{}, errors.Wrapf(err, "source %s", name)
+	}
+	if nc == nil {
+		return llb.State{}, errors.Errorf("source %s: build context %q not provided (pass --build-context %s=<dir, docker-image://ref or git URL>)", name, cname, cname)
+	}
+	st, _, err := nc.Load(ctx)
+	if err != nil {
+		return llb.State{}, errors.Wrapf(err, "source %s: load build context %q", name, cname)
+	}
+	return *st, nil
+}
+
+// contextOpt returns the options namedContext loads the build context of c with.
+func contextOpt(c *specpkg.SourceContext, p ocispecs.Platform) dockerui.ContextOpt {
+	return dockerui.ContextOpt{
+		Platform: &p,
+		AsyncLocalOpts: func() []llb.LocalOption {
+			var opts []llb.LocalOption
+			if len(c.Include) > 0 {
+				opts = append(opts, llb.IncludePatterns(c.Include))
+			}
+			if len(c.Exclude) > 0 {
+				opts = append(opts, llb.ExcludePatterns(c.Exclude))
+			}
+			return opts
+		},
+	}
+}
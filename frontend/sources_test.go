@@ -0,0 +1,45 @@
+package frontend
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	specpkg "github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func TestContextOpt(t *testing.T) {
+	p := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+	for _, tt := range []struct {
+		name             string
+		c                specpkg.SourceContext
+		include, exclude string // JSON, as llb.Local records them
+	}{
+		{"everything", specpkg.SourceContext{}, "", ""},
+		{"include", specpkg.SourceContext{Include: []string{"src", "go.mod"}}, `["src","go.mod"]`, ""},
+		{"exclude", specpkg.SourceContext{Exclude: []string{"**/*.o"}}, "", `["**/*.o"]`},
+		{"both", specpkg.SourceContext{Name: "vendor", Include: []string{"src"}, Exclude: []string{"src/testdata"}}, `["src"]`, `["src/testdata"]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := contextOpt(&tt.c, p)
+			if opt.Platform == nil || opt.Platform.Architecture != "arm64" {
+				t.Errorf("platform = %v, want %v", opt.Platform, p)
+			}
+			var li llb.LocalInfo
+			for _, o := range opt.AsyncLocalOpts() {
+				o.SetLocalOption(&li)
+			}
+			if li.IncludePatterns != tt.include || li.ExcludePatterns != tt.exclude {
+				t.Errorf("include %s, exclude %s; want %s, %s", li.IncludePatterns, li.ExcludePatterns, tt.include, tt.exclude)
+			}
+		})
+	}
+}
+
+func TestSourceNames(t *testing.T) {
+	s := &specpkg.Spec{Sources: map[string]specpkg.Source{"vendor": {}, "assets": {}, "hello": {}}}
+	if got, want := sourceNames(s), []string{"assets", "hello", "vendor"}; !slices.Equal(got, want) {
+		t.Errorf("sourceNames = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package frontend
+
+import (
+	"crypto/rsa"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tuananh/apkbuild/pkg/apk"
+)
+
+const (
+	// buildArgVerify (a boolean) re-reads every assembled package and fails the build unless it
+	// verifies: signature, datahash and per-file checksums.
+	buildArgVerify = "APK_VERIFY"
+	// buildArgVerifyKeys lists the trusted public keys (comma-separated paths in the build
+	// context) the signature is checked against. Required when packages are signed.
+	buildArgVerifyKeys = "APK_VERIFY_KEYS"
+)
+
+// verifyOptions returns the options for checking assembled packages, or nil when APK_VERIFY is
+// not enabled. Keys are read with readFile from the build context and named by their base name.
+func verifyOptions(buildArgs map[string]string, readFile func(string) ([]byte, error), signed bool) (*apk.VerifyOptions, error) {
+	enabled, paths, err := verifyKeyPaths(buildArgs, signed)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, p := range paths {
+		data, err := readFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: read %s", buildArgVerifyKeys, p)
+		}
+		key, err := apk.ParsePublicKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: %s", buildArgVerifyKeys, p)
+		}
+		keys[path.Base(p)] = key
+	}
+	// Unsigned packages are only checked for a signature when keys were given explicitly.
+	return &apk.VerifyOptions{Keys: keys, AllowUntrusted: len(keys) == 0}, nil
+}
+
+// verifyKeyPaths reports whether APK_VERIFY is enabled and returns the key paths of
+// APK_VERIFY_KEYS, which are required when packages are signed.
+func verifyKeyPaths(buildArgs map[string]string, signed bool) (bool, []string, error) {
+	v, ok := buildArgs[buildArgVerify]
+	if !ok || v == "" {
+		return false, nil, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, nil, errors.Wrapf(err, "%s", buildArgVerify)
+	}
+	if !enabled {
+		return false, nil, nil
+	}
+	var paths []string
+	for _, p := range strings.Split(buildArgs[buildArgVerifyKeys], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if signed && len(paths) == 0 {
+		return false, nil, errors.Errorf("%s with signing requires %s (public key in the build context)", buildArgVerify, buildArgVerifyKeys)
+	}
+	return true, paths, nil
+}
+
+// verifyAPK checks the package at path with opts.
+func verifyAPK(path string, opts apk.VerifyOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = apk.Verify(f, opts)
+	return err
+}
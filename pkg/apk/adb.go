@@ -0,0 +1,149 @@
+package apk
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ADB is the apk-tools 3 container format (src/adb.h):
+//
+//	file  = "ADB." schema(u32le) block...      (optionally compressed, see writeV3)
+//	block = type_size(u32le) payload padding   type in the top 2 bits, size (header included) below,
+//	                                           padded to 8 bytes
+//
+// The ADB block holds a tree of 32-bit values: the top 4 bits are the type, the rest an inline
+// integer or the offset of the value's data within the block. Objects and arrays are vectors
+// of values whose first slot is the slot count; object fields are addressed by 1-based index.
+// The root value is the last value of the block.
+const (
+	adbMagic         = "ADB."
+	adbSchemaPackage = 0x676b6370 // "pckg"
+
+	adbBlockADB  = 0
+	adbBlockSig  = 1
+	adbBlockData = 2
+	adbBlockExt  = 3
+
+	adbBlockAlign = 8
+)
+
+// adbVal is an ADB value.
+type adbVal uint32
+
+const (
+	adbNull       adbVal = 0x00000000
+	adbTypeInt    adbVal = 0x10000000
+	adbTypeInt32  adbVal = 0x20000000
+	adbTypeInt64  adbVal = 0x30000000
+	adbTypeBlob8  adbVal = 0x80000000
+	adbTypeBlob16 adbVal = 0x90000000
+	adbTypeBlob32 adbVal = 0xa0000000
+	adbTypeArray  adbVal = 0xd0000000
+	adbTypeObject adbVal = 0xe0000000
+	adbValueMask         = 0x0fffffff
+)
+
+// adbWriter appends values to an ADB block.
+type adbWriter struct {
+	buf []byte
+}
+
+// data aligns the block to align and appends the parts, returning their offset.
+func (w *adbWriter) data(align int, parts ...[]byte) adbVal {
+	for len(w.buf)%align != 0 {
+		w.buf = append(w.buf, 0)
+	}
+	off := len(w.buf)
+	for _, p := range parts {
+		w.buf = append(w.buf, p...)
+	}
+	return adbVal(off)
+}
+
+// int writes an integer: inline when it fits in 28 bits, out of line otherwise.
+func (w *adbWriter) int(v uint64) adbVal {
+	switch {
+	case v > 0xffffffff:
+		return adbTypeInt64 | w.data(8, binary.LittleEndian.AppendUint64(nil, v))
+	case v > adbValueMask:
+		return adbTypeInt32 | w.data(4, binary.LittleEndian.AppendUint32(nil, uint32(v)))
+	}
+	return adbTypeInt | adbVal(v)
+}
+
+// blob writes a length-prefixed byte string; empty blobs are null.
+func (w *adbWriter) blob(b []byte) adbVal {
+	switch n := len(b); {
+	case n == 0:
+		return adbNull
+	case n > 0xffff:
+		return adbTypeBlob32 | w.data(4, binary.LittleEndian.AppendUint32(nil, uint32(n)), b)
+	case n > 0xff:
+		return adbTypeBlob16 | w.data(2, binary.LittleEndian.AppendUint16(nil, uint16(n)), b)
+	default:
+		return adbTypeBlob8 | w.data(1, []byte{byte(n)}, b)
+	}
+}
+
+func (w *adbWriter) str(s string) adbVal { return w.blob([]byte(s)) }
+
+// vector writes an object (fields 1..n) or array; trailing nulls are dropped and an empty
+// vector is null.
+func (w *adbWriter) vector(typ adbVal, vals []adbVal) adbVal {
+	n := len(vals)
+	for n > 0 && vals[n-1] == adbNull {
+		n--
+	}
+	if n == 0 {
+		return adbNull
+	}
+	b := binary.LittleEndian.AppendUint32(nil, uint32(n+1))
+	for _, v := range vals[:n] {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	return typ | w.data(4, b)
+}
+
+// object writes an object whose field i+1 is fields[i].
+func (w *adbWriter) object(fields ...adbVal) adbVal { return w.vector(adbTypeObject, fields) }
+
+func (w *adbWriter) array(items []adbVal) adbVal { return w.vector(adbTypeArray, items) }
+
+// finish writes the root value and returns the block payload.
+func (w *adbWriter) finish(root adbVal) []byte {
+	w.data(4, binary.LittleEndian.AppendUint32(nil, uint32(root)))
+	return w.buf
+}
+
+// writeADBBlockHeader writes the header of a block with a payload of length bytes and returns
+// the padding that must follow the payload.
+func writeADBBlockHeader(w io.Writer, typ uint32, length uint64) (int, error) {
+	var hdr []byte
+	size := 4 + length
+	if size <= 0x3fffffff {
+		hdr = binary.LittleEndian.AppendUint32(nil, typ<<30|uint32(size))
+	} else {
+		// Extended header: type in the low bits, 64-bit size (header included).
+		size = 16 + length
+		hdr = binary.LittleEndian.AppendUint32(nil, adbBlockExt<<30|typ)
+		hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+		hdr = binary.LittleEndian.AppendUint64(hdr, size)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return 0, err
+	}
+	return int((adbBlockAlign - size%adbBlockAlign) % adbBlockAlign), nil
+}
+
+// writeADBBlock writes a whole block with its padding.
+func writeADBBlock(w io.Writer, typ uint32, payload []byte) error {
+	pad, err := writeADBBlockHeader(w, typ, uint64(len(payload)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	_, err = w.Write(make([]byte, pad))
+	return err
+}
@@ -0,0 +1,142 @@
+package apk
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// ArchNoarch marks an architecture-independent package (spec `arch: noarch`).
+const ArchNoarch = "noarch"
+
+// ArchFromPlatform maps an OCI platform (GOARCH + variant) to the Alpine architecture name
+// used in .PKGINFO and repository paths (x86_64, aarch64, armv7, ...).
+func ArchFromPlatform(p ocispecs.Platform) (string, error) {
+	switch p.Architecture {
+	case "amd64":
+		return "x86_64", nil
+	case "386":
+		return "x86", nil
+	case "arm64":
+		return "aarch64", nil
+	case "arm":
+		switch p.Variant {
+		case "v6", "v5":
+			return "armhf", nil
+		case "", "v7", "v8":
+			return "armv7", nil
+		}
+	case "ppc64le":
+		return "ppc64le", nil
+	case "s390x":
+		return "s390x", nil
+	case "riscv64":
+		return "riscv64", nil
+	case "loong64":
+		return "loongarch64", nil
+	}
+	if p.Variant != "" {
+		return "", fmt.Errorf("unsupported platform architecture %s/%s", p.Architecture, p.Variant)
+	}
+	return "", fmt.Errorf("unsupported platform architecture %s", p.Architecture)
+}
+
+// PackageArch returns the arch written to .PKGINFO for s built on platformArch:
+// "noarch" when the spec says so, otherwise platformArch.
+func PackageArch(s *spec.Spec, platformArch string) string {
+	if s.Arch == ArchNoarch {
+		return ArchNoarch
+	}
+	return platformArch
+}
+
+// gnuTriplets are the GNU triplets of the Alpine toolchains (abuild's arch_to_hostspec).
+var gnuTriplets = map[string]string{
+	"x86_64":      "x86_64-alpine-linux-musl",
+	"x86":         "i586-alpine-linux-musl",
+	"aarch64":     "aarch64-alpine-linux-musl",
+	"armv7":       "armv7-alpine-linux-musleabihf",
+	"armhf":       "armv6-alpine-linux-musleabihf",
+	"ppc64le":     "powerpc64le-alpine-linux-musl",
+	"s390x":       "s390x-alpine-linux-musl",
+	"riscv64":     "riscv64-alpine-linux-musl",
+	"loongarch64": "loongarch64-alpine-linux-musl",
+}
+
+// GNUTriplet returns the GNU triplet of an Alpine arch, e.g. aarch64-alpine-linux-musl.
+func GNUTriplet(arch string) (string, error) {
+	t, ok := gnuTriplets[arch]
+	if !ok {
+		return "", fmt.Errorf("no GNU triplet for arch %q", arch)
+	}
+	return t, nil
+}
+
+// elfArch maps an ELF machine to the Alpine architecture name (32-bit ARM reported as armv7).
+func elfArch(f *elf.File) (string, bool) {
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "x86_64", true
+	case elf.EM_386:
+		return "x86", true
+	case elf.EM_AARCH64:
+		return "aarch64", true
+	case elf.EM_ARM:
+		return "armv7", true
+	case elf.EM_PPC64:
+		if f.ByteOrder == binary.LittleEndian {
+			return "ppc64le", true
+		}
+	case elf.EM_S390:
+		return "s390x", true
+	case elf.EM_RISCV:
+		return "riscv64", true
+	case elf.EM_LOONGARCH:
+		return "loongarch64", true
+	}
+	return "", false
+}
+
+// sameArch reports whether a and b are compatible; ELF headers cannot tell armhf from armv7.
+func sameArch(a, b string) bool {
+	if a == b {
+		return true
+	}
+	arm := func(s string) bool { return s == "armv7" || s == "armhf" }
+	return arm(a) && arm(b)
+}
+
+// addArch records the arch of the ELF executable or shared object name. Unless the package is
+// noarch, files of different architectures are an error: a package holds binaries for one arch.
+func (s *fileScan) addArch(name string, f *elf.File) error {
+	a, ok := elfArch(f)
+	switch {
+	case !ok || s.want == ArchNoarch:
+	case s.arch == "":
+		s.arch, s.archFile = a, name
+	case !sameArch(a, s.arch):
+		return fmt.Errorf("detect arch: %s is an %s binary but %s is an %s binary", s.archFile, s.arch, name, a)
+	}
+	return nil
+}
+
+// resolveArch returns the arch for the package. want is the arch from the build platform (or
+// "noarch"); when empty, the arch of the ELF binaries is used, and a package without any is an
+// error. Packages that are not noarch are cross-checked against the ELF binaries they contain.
+func (s *fileScan) resolveArch() (string, error) {
+	switch {
+	case s.want == ArchNoarch:
+		return ArchNoarch, nil
+	case s.want == "" && s.arch != "":
+		return s.arch, nil
+	case s.want == "":
+		return "", errors.New("cannot tell the package arch: there are no ELF binaries, set the arch (apkbuild assemble -arch) or `arch: noarch` in the spec")
+	case s.arch != "" && !sameArch(s.arch, s.want):
+		return "", fmt.Errorf("package arch is %s but %s is an %s binary (set `arch: noarch` to skip this check)", s.want, s.archFile, s.arch)
+	}
+	return s.want, nil
+}
@@ -0,0 +1,110 @@
+package apk
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testELF returns a 64-bit little-endian ELF executable header for machine, with no sections.
+func testELF(machine elf.Machine) []byte {
+	b := make([]byte, 64)
+	copy(b, elf.ELFMAG)
+	b[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	b[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	b[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.LittleEndian.PutUint16(b[16:], uint16(elf.ET_EXEC))
+	binary.LittleEndian.PutUint16(b[18:], uint16(machine))
+	binary.LittleEndian.PutUint32(b[20:], uint32(elf.EV_CURRENT))
+	binary.LittleEndian.PutUint16(b[52:], 64) // e_ehsize
+	return b
+}
+
+func TestResolveArch(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    string
+		arch    string
+		wantErr string
+	}{
+		{
+			name:  "matching",
+			files: fstest.MapFS{"usr/bin/a": {Data: testELF(elf.EM_X86_64), Mode: 0o755}, "usr/bin/b": {Data: testELF(elf.EM_X86_64), Mode: 0o755}},
+			want:  "x86_64",
+			arch:  "x86_64",
+		},
+		{
+			name:  "detected",
+			files: fstest.MapFS{"usr/bin/a": {Data: testELF(elf.EM_AARCH64), Mode: 0o755}},
+			arch:  "aarch64",
+		},
+		{
+			name:    "platform mismatch",
+			files:   fstest.MapFS{"usr/bin/a": {Data: testELF(elf.EM_AARCH64), Mode: 0o755}},
+			want:    "x86_64",
+			wantErr: "usr/bin/a is an aarch64 binary",
+		},
+		{
+			name: "mixed",
+			files: fstest.MapFS{
+				"usr/bin/a":         {Data: testELF(elf.EM_X86_64), Mode: 0o755},
+				"usr/libexec/stray": {Data: testELF(elf.EM_AARCH64), Mode: 0o755},
+			},
+			want:    "x86_64",
+			wantErr: "usr/libexec/stray is an aarch64 binary",
+		},
+		{
+			name:  "noarch",
+			files: fstest.MapFS{"usr/bin/a": {Data: testELF(elf.EM_AARCH64), Mode: 0o755}},
+			want:  ArchNoarch,
+			arch:  ArchNoarch,
+		},
+		{
+			name:  "no ELF files",
+			files: fstest.MapFS{"usr/bin/a": {Data: []byte("#!/bin/sh\n"), Mode: 0o755}},
+			want:  "riscv64",
+			arch:  "riscv64",
+		},
+		{
+			name:    "no ELF files and no arch",
+			files:   fstest.MapFS{"usr/bin/a": {Data: []byte("#!/bin/sh\n"), Mode: 0o755}},
+			wantErr: "no ELF binaries",
+		},
+		{
+			name:  "noarch with mixed binaries",
+			files: fstest.MapFS{"a": {Data: testELF(elf.EM_X86_64)}, "b": {Data: testELF(elf.EM_AARCH64)}},
+			want:  ArchNoarch,
+			arch:  ArchNoarch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := Assemble(&buf, tt.files, testSpec(), AssembleOptions{Arch: tt.want})
+			var arch string
+			if err == nil {
+				pi, _, rerr := ReadPKGInfo(&buf)
+				if rerr != nil {
+					t.Fatal(rerr)
+				}
+				arch = pi.Arch
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %q, %v; want error containing %q", arch, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if arch != tt.arch {
+				t.Errorf("arch = %q, want %q", arch, tt.arch)
+			}
+		})
+	}
+}
@@ -2,13 +2,17 @@
 // https://gist.github.com/tcurdt/512beaac7e9c12dcf5b6b7603b09d0d8
 // APK = control.tgz + data.tgz (optionally signature.tgz first).
 // Data tgz: full tar of package files, gzipped, padded to 512-byte boundary, digest SHA256.
-// Control tgz: .PKGINFO only, tar "cut" (no padding), digest SHA1.
+// Data entries use PAX headers carrying APK-TOOLS.checksum.SHA1 (as abuild-tar --hash does).
+// Control tgz: .PKGINFO then install scripts (.pre-install, ..., .trigger), tar "cut" (no padding), digest SHA1.
+// Signature tgz: .SIGN.RSA.<keyname> (or .SIGN.RSA256.) holding the signature over the control tgz, tar "cut".
+// The apk-tools 3 (ADB) format is written by writeV3 instead, see AssembleOptions.Format.
 
 package apk
 
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -16,6 +20,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -38,13 +43,41 @@ func (c *writerCounter) Write(p []byte) (n int, err error) {
 
 func (c *writerCounter) countVal() uint64 { return atomic.LoadUint64(&c.count) }
 
+// paxChecksumSHA1 is the PAX record apk-tools reads for per-file checksums (apk audit/verify).
+const paxChecksumSHA1 = "APK-TOOLS.checksum.SHA1"
+
 func writeTarDir(tw *tar.Writer, h *tar.Header) error {
 	h.ChangeTime = time.Time{}
 	h.AccessTime = time.Time{}
-	h.Format = tar.FormatUSTAR
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	h.Format = tar.FormatPAX
+	return tw.WriteHeader(h)
+}
+
+// writeDataHeader writes the header of a data segment entry with a PAX header. Regular files
+// carry sum, the hex SHA1 of their content, symlinks the SHA1 of their target.
+func writeDataHeader(tw *tar.Writer, h *tar.Header, sum string) error {
+	h.ChangeTime = time.Time{}
+	h.AccessTime = time.Time{}
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	h.Format = tar.FormatPAX
+	switch h.Typeflag {
+	case tar.TypeReg:
+		setPAXRecord(h, paxChecksumSHA1, sum)
+	case tar.TypeSymlink:
+		sum := sha1.Sum([]byte(h.Linkname))
+		setPAXRecord(h, paxChecksumSHA1, hex.EncodeToString(sum[:]))
+	}
 	return tw.WriteHeader(h)
 }
 
+func setPAXRecord(h *tar.Header, key, value string) {
+	if h.PAXRecords == nil {
+		h.PAXRecords = make(map[string]string)
+	}
+	h.PAXRecords[key] = value
+}
+
 func writeTarFile(tw *tar.Writer, h *tar.Header, r io.Reader) error {
 	h.Format = tar.FormatUSTAR
 	h.ChangeTime = time.Time{}
@@ -67,6 +100,7 @@ const (
 // digest receives the same bytes as w. Returns the digest sum.
 func writeTgz(w io.Writer, kind tarKind, build func(tw *tar.Writer) error, digest hash.Hash) ([]byte, error) {
 	mw := io.MultiWriter(digest, w)
+	// gzip.Writer leaves name and mtime empty and OS "unknown", so the header carries no host metadata.
 	gz := gzip.NewWriter(mw)
 	cw := &writerCounter{writer: gz}
 	bw := bufio.NewWriterSize(cw, 4096)
@@ -96,119 +130,317 @@ func writeTgz(w io.Writer, kind tarKind, build func(tw *tar.Writer) error, diges
 	return digest.Sum(nil), nil
 }
 
-// AssembleAPK writes an APK file to outPath by packing the directory dataDir.
-// Metadata comes from the spec; built files under dataDir are packed as the data tgz,
-// then .PKGINFO and control tgz are built, and control + data are concatenated into the APK.
-// No signing (signature tgz is omitted).
-func AssembleAPK(dataDir, outPath string, s *spec.Spec) error {
+// dataHeader returns the tar header for the entry name of src. Symlinks keep their target,
+// the second and later names of a hardlinked file become TypeLink entries pointing at the first
+// name seen (links tracks names by inode, or the source reports the link itself, see Assemble),
+// and FIFOs and device nodes are packed with their device numbers. Sockets and other types apk
+// cannot install are rejected.
+func dataHeader(src fs.FS, name string, info fs.FileInfo, links map[fileID]string) (*tar.Header, error) {
+	var target string
+	switch mode := info.Mode(); {
+	case mode&fs.ModeSymlink != 0:
+		t, err := fs.ReadLink(src, name)
+		if err != nil {
+			return nil, err
+		}
+		target = t
+	case mode&fs.ModeSocket != 0, mode&fs.ModeIrregular != 0:
+		return nil, fmt.Errorf("%s: unsupported file type %s (apk packages may contain regular files, directories, symlinks, hardlinks, FIFOs and device nodes)", name, mode.Type())
+	}
+	h, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	h.Name = name
+	if sys, ok := info.Sys().(*tar.Header); ok && (h.Typeflag == tar.TypeChar || h.Typeflag == tar.TypeBlock) {
+		// FileInfoHeader only takes device numbers from syscall.Stat_t.
+		h.Devmajor, h.Devminor = sys.Devmajor, sys.Devminor
+	}
+	if h.Typeflag == tar.TypeReg {
+		if id, ok := hardlinkID(info); ok {
+			if first, seen := links[id]; seen {
+				h.Typeflag = tar.TypeLink
+				h.Linkname = first
+				h.Size = 0
+			} else {
+				links[id] = name
+			}
+		}
+	}
+	return h, nil
+}
+
+// Package formats AssembleAPK can write (AssembleOptions.Format, spec package.format).
+const (
+	// FormatV2 is the apk-tools 2 format: [signature +] control + data gzip streams.
+	FormatV2 = "v2"
+	// FormatV3 is the apk-tools 3 ADB format (see adb.go and assemble_v3.go).
+	FormatV3 = "v3"
+)
+
+// packageWriter writes the package for the tree src to out. pkginfo holds the spec metadata and
+// builddate. Writers read each file of src once, hand every entry to scan and call
+// scan.complete, which sets the arch and detected dependencies, before writing the metadata.
+type packageWriter func(out io.Writer, src fs.FS, pkginfo *PKGInfo, scan *fileScan, s *spec.Spec, opts AssembleOptions) error
+
+var packageWriters = map[string]packageWriter{
+	FormatV2: writeV2,
+	FormatV3: writeV3,
+}
+
+// ValidateFormat checks that format is empty (v2) or a known package format.
+func ValidateFormat(format string) error {
+	if _, ok := packageWriters[format]; !ok && format != "" {
+		return fmt.Errorf("unsupported package format %q (use %s or %s)", format, FormatV2, FormatV3)
+	}
+	return nil
+}
+
+// AssembleOptions controls optional parts of APK assembly.
+type AssembleOptions struct {
+	// Format is FormatV2 (default) or FormatV3.
+	Format string
+	// Signer, if set, signs the control segment and the signature tgz is prepended to the APK
+	// (v2), or signs the ADB block into a signature block (v3, must implement PublicKeySigner).
+	Signer Signer
+	// SignatureType is SignatureRSA (default, SHA1) or SignatureRSA256. v3 always uses SHA512.
+	SignatureType string
+	// Arch is the package architecture from the build platform (see ArchFromPlatform and
+	// PackageArch), or "noarch". ELF binaries in dataDir must match it.
+	Arch string
+	// SourceDateEpoch, if set, makes the output reproducible: mtimes are clamped to it and
+	// owners are forced to root:root. Entries are always in lexical order and gzip headers
+	// never carry timestamps, so two builds of the same tree are byte-identical.
+	SourceDateEpoch *time.Time
+}
+
+// normalize applies the reproducible-build rules to h when SourceDateEpoch is set.
+func (o AssembleOptions) normalize(h *tar.Header) {
+	if o.SourceDateEpoch == nil {
+		return
+	}
+	if h.ModTime.IsZero() || h.ModTime.After(*o.SourceDateEpoch) {
+		h.ModTime = *o.SourceDateEpoch
+	}
+	h.Uid, h.Gid = 0, 0
+	h.Uname, h.Gname = "root", "root"
+}
+
+// AssembleAPK writes an APK file to outPath by packing the directory dataDir (see Assemble).
+func AssembleAPK(dataDir, outPath string, s *spec.Spec, opts AssembleOptions) error {
 	dataDir = filepath.Clean(dataDir)
 	if dataDir == "" || dataDir == "." {
 		dataDir, _ = filepath.Abs(dataDir)
 	}
-
-	var dataSize int64
-	dataDigest := sha256.New()
-	dataTgz, err := os.CreateTemp("", "apk-data-*.tgz")
+	out, err := os.Create(outPath)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(dataTgz.Name())
-	defer dataTgz.Close()
+	if err := Assemble(out, os.DirFS(dataDir), s, opts); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	dataHash, err := writeTgz(dataTgz, tarFull, func(tw *tar.Writer) error {
-		return filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			rel, err := filepath.Rel(dataDir, path)
-			if err != nil {
-				return err
-			}
-			// APK expects forward slashes and no leading ./
-			name := filepath.ToSlash(rel)
-			if name == "." {
-				return nil
-			}
-			h, err := tar.FileInfoHeader(info, name)
-			if err != nil {
-				return err
-			}
-			h.Name = name
+// Assemble writes the package for the tree src to out, in the format selected by opts.Format.
+// Metadata comes from the spec, the arch from opts.Arch (checked against the ELF files) and
+// so:/cmd:/pc: entries from the files unless disabled.
+//
+// src is read entry by entry, and every file exactly once, so it can be a remote tree (the
+// frontend passes a BuildKit reference). Both formats hash the files before the metadata that
+// precedes them, so the package is made in one temporary file and copied to out. Symlinks are
+// read with fs.ReadLink. A source without inodes can report hardlinks and ownership by returning
+// a *tar.Header from FileInfo.Sys (Typeflag TypeLink, Linkname relative to the root; Uid, Gid,
+// device numbers).
+func Assemble(out io.Writer, src fs.FS, s *spec.Spec, opts AssembleOptions) error {
+	if err := ValidateFormat(opts.Format); err != nil {
+		return err
+	}
+	write := packageWriters[opts.Format]
+	if opts.Format == "" {
+		write = writeV2
+	}
 
-			if info.IsDir() {
-				return writeTarDir(tw, h)
-			}
+	pkginfo := newPKGInfo(s)
+	pkginfo.BuildDate = time.Now().Unix()
+	if opts.SourceDateEpoch != nil {
+		pkginfo.BuildDate = opts.SourceDateEpoch.Unix()
+	}
+	return write(out, src, pkginfo, newFileScan(opts.Arch, s.Dependencies.Auto), s, opts)
+}
 
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			dataSize += info.Size()
-			err = writeTarFile(tw, h, f)
-			f.Close()
-			return err
-		})
-	}, dataDigest)
+// writeV2 writes the v2 package: [signature +] control + data. The control segment carries the
+// datahash of the data segment that follows it, so the data segment is made first, in a single
+// pass over src, in one temporary file (see writeDataTgz), and copied to out after the control
+// segment.
+func writeV2(out io.Writer, src fs.FS, pkginfo *PKGInfo, scan *fileScan, s *spec.Spec, opts AssembleOptions) error {
+	_, newControlHash, err := signatureHash(opts.SignatureType)
 	if err != nil {
-		return fmt.Errorf("data tgz: %w", err)
+		return err
 	}
 
-	pkgrel := "0"
-	if s.Epoch > 0 {
-		pkgrel = fmt.Sprintf("%d", s.Epoch)
-	}
-	pkgver := fmt.Sprintf("%s-r%s", s.Version, pkgrel)
-	// .PKGINFO format (key = value, one per line)
-	var pkginfo strings.Builder
-	pkginfo.WriteString("# Generated\n")
-	fmt.Fprintf(&pkginfo, "pkgname = %s\n", strings.ToLower(s.Name))
-	fmt.Fprintf(&pkginfo, "pkgver = %s\n", pkgver)
-	fmt.Fprintf(&pkginfo, "pkgdesc = %s\n", s.Description)
-	fmt.Fprintf(&pkginfo, "url = %s\n", s.URL)
-	fmt.Fprintf(&pkginfo, "arch = noarch\n")
-	fmt.Fprintf(&pkginfo, "size = %d\n", dataSize)
-	fmt.Fprintf(&pkginfo, "datahash = %s\n", hex.EncodeToString(dataHash))
-	if s.License != "" {
-		fmt.Fprintf(&pkginfo, "license = %s\n", s.License)
-	}
-	for _, d := range s.Dependencies.Runtime {
-		fmt.Fprintf(&pkginfo, "depend = %s\n", d)
+	data, err := newSpool()
+	if err != nil {
+		return err
 	}
-	pkginfoBytes := pkginfo.String()
-
-	controlTgz, err := os.CreateTemp("", "apk-control-*.tgz")
+	defer data.Close()
+	dataTgz, dataHash, dataSize, err := writeDataTgz(data, src, opts, scan)
 	if err != nil {
+		return fmt.Errorf("data tgz: %w", err)
+	}
+	if err := scan.complete(pkginfo); err != nil {
 		return err
 	}
-	defer os.Remove(controlTgz.Name())
-	defer controlTgz.Close()
+	pkginfo.Size = dataSize
+	pkginfo.DataHash = hex.EncodeToString(dataHash)
+	pkginfoBytes := pkginfo.Bytes()
 
-	_, err = writeTgz(controlTgz, tarCut, func(tw *tar.Writer) error {
+	// The control segment is small (.PKGINFO and scripts), so it is kept in memory.
+	var controlTgz bytes.Buffer
+	controlHash, err := writeTgz(&controlTgz, tarCut, func(tw *tar.Writer) error {
 		h := &tar.Header{
 			Name: ".PKGINFO",
 			Mode: 0o600,
 			Size: int64(len(pkginfoBytes)),
 		}
-		return writeTarFile(tw, h, strings.NewReader(pkginfoBytes))
-	}, sha1.New())
+		opts.normalize(h)
+		if err := writeTarFile(tw, h, bytes.NewReader(pkginfoBytes)); err != nil {
+			return err
+		}
+		for _, f := range scriptFiles(&s.Scripts) {
+			if f.script.Path != "" {
+				return fmt.Errorf("scripts.%s: path %q was not resolved (see ResolveScripts)", f.field, f.script.Path)
+			}
+			if f.script.Run == "" {
+				continue
+			}
+			content := scriptContent(f.script)
+			h := &tar.Header{
+				Name: f.name,
+				Mode: 0o755,
+				Size: int64(len(content)),
+			}
+			opts.normalize(h)
+			if err := writeTarFile(tw, h, bytes.NewReader(content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, newControlHash())
 	if err != nil {
 		return fmt.Errorf("control tgz: %w", err)
 	}
 
-	out, err := os.Create(outPath)
-	if err != nil {
+	var signatureTgz []byte
+	if opts.Signer != nil {
+		signatureTgz, err = buildSignatureTgz(opts.Signer, opts.SignatureType, controlHash)
+		if err != nil {
+			return fmt.Errorf("signature tgz: %w", err)
+		}
+	}
+
+	// APK = [signature +] control + data
+	if _, err := out.Write(signatureTgz); err != nil {
+		return err
+	}
+	if _, err := controlTgz.WriteTo(out); err != nil {
 		return err
 	}
-	defer out.Close()
+	if _, err := io.Copy(out, dataTgz); err != nil {
+		return fmt.Errorf("data tgz: %w", err)
+	}
+	return nil
+}
+
+// sha1Placeholder is the checksum of a regular file in its PAX header until the file has been
+// copied; the record has a fixed length, so the value is then overwritten in place.
+var sha1Placeholder = strings.Repeat("0", sha1.Size*2)
+
+// writeDataTgz writes the data segment of src to sp and returns a reader for it, its SHA256
+// and the installed size. The data tar is written first: each regular file is read once,
+// copied into the tar after its header and hashed on the way, then scanned from the copy, and
+// its SHA1 is filled into the header. The tar is then compressed to the end of sp.
+func writeDataTgz(sp *spool, src fs.FS, opts AssembleOptions, scan *fileScan) (*io.SectionReader, []byte, int64, error) {
+	buf := make([]byte, 32<<10)
+	tw := tar.NewWriter(sp)
+	var size int64
+	links := make(map[fileID]string)
+	// fs.WalkDir visits entries in lexical order, so the data tar is deterministic.
+	err := fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// APK expects forward slashes and no leading ./
+		if name == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		h, err := dataHeader(src, name, info, links)
+		if err != nil {
+			return err
+		}
+		opts.normalize(h)
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			return writeTarDir(tw, h)
+		case tar.TypeReg:
+		default:
+			if err := scan.add(h, nil); err != nil {
+				return err
+			}
+			return writeDataHeader(tw, h, "")
+		}
 
-	// APK = control + data (no signature)
-	for _, f := range []*os.File{controlTgz, dataTgz} {
-		if _, err := f.Seek(0, io.SeekStart); err != nil {
+		// Flush pads the previous file, so the header starts at hdrOff.
+		if err := tw.Flush(); err != nil {
 			return err
 		}
-		if _, err := io.Copy(out, f); err != nil {
+		hdrOff := sp.size
+		if err := writeDataHeader(tw, h, sha1Placeholder); err != nil {
 			return err
 		}
+		sumOff, err := sp.paxSHA1Offset(hdrOff)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		off := sp.size
+		sum := sha1.New()
+		// Hide tar.Writer's ReadFrom so buf is used instead of a new buffer per file.
+		if err := copyFile(io.MultiWriter(struct{ io.Writer }{tw}, sum), src, name, h.Size, buf); err != nil {
+			return err
+		}
+		if err := scan.add(h, sp.Section(off, h.Size)); err != nil {
+			return err
+		}
+		size += h.Size
+		_, err = sp.WriteAt([]byte(hex.EncodeToString(sum.Sum(nil))), sumOff)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
 	}
-	return nil
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	tarSize := sp.size
+	digest := sha256.New()
+	bw := bufio.NewWriterSize(io.MultiWriter(sp, digest), len(buf))
+	// gzip.Writer leaves name and mtime empty and OS "unknown", so the header carries no host metadata.
+	gz := gzip.NewWriter(bw)
+	if _, err := io.CopyBuffer(gz, sp.Section(0, tarSize), buf); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, nil, 0, err
+	}
+	return sp.Section(tarSize, sp.size-tarSize), digest.Sum(nil), size, nil
 }
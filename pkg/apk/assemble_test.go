@@ -0,0 +1,250 @@
+package apk
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden packages in testdata")
+
+// goldenTree is the tree of testdata/hello-1.0-r2.apk: richTree plus an ELF executable, a
+// pkg-config file and a file larger than the copy buffers.
+func goldenTree() fstest.MapFS {
+	tree := richTree()
+	tree["usr/bin/hello-bin"] = &fstest.MapFile{Data: testELF(elf.EM_X86_64), Mode: 0o755, ModTime: testEpoch}
+	tree["usr/lib"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: testEpoch}
+	tree["usr/lib/pkgconfig"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: testEpoch}
+	tree["usr/lib/pkgconfig/hello.pc"] = &fstest.MapFile{
+		Data:    []byte("prefix=/usr\nName: hello\nVersion: 1.0\nRequires: zlib >= 1.2\n"),
+		Mode:    0o644,
+		ModTime: testEpoch,
+	}
+	tree["usr/share/hello/big.dat"] = &fstest.MapFile{Data: pseudoRandom(1, 64<<10), Mode: 0o644, ModTime: testEpoch}
+	return tree
+}
+
+// pseudoRandom returns n deterministic bytes that compress to about half their size.
+func pseudoRandom(seed uint64, n int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.IntN(16))
+	}
+	return b
+}
+
+func goldenSigner(t testing.TB) *RSASigner {
+	t.Helper()
+	pemData, err := os.ReadFile(filepath.Join("testdata", "test.rsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRSASigner("test", pemData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func goldenOptions(t testing.TB) AssembleOptions {
+	return AssembleOptions{Arch: "x86_64", Signer: goldenSigner(t), SourceDateEpoch: &testEpoch}
+}
+
+// writeTree writes tree to dir, with hardlinks reported through Sys as os.Link.
+func writeTree(t testing.TB, dir string, tree fstest.MapFS) {
+	t.Helper()
+	err := fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		f := tree[name]
+		p := filepath.Join(dir, name)
+		switch {
+		case f.Mode.IsDir():
+			err = os.Mkdir(p, f.Mode.Perm())
+		case f.Mode&fs.ModeSymlink != 0:
+			return os.Symlink(string(f.Data), p)
+		case f.Sys != nil:
+			err = os.Link(filepath.Join(dir, "usr/share/hello/a.txt"), p)
+		default:
+			if err = os.WriteFile(p, f.Data, f.Mode.Perm()); err == nil {
+				err = os.Chmod(p, f.Mode.Perm()|f.Mode&fs.ModeSetuid)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, testEpoch, testEpoch)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodedSegments returns the decompressed gzip members of a v2 package.
+func decodedSegments(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	sr := newSegmentReader(bytes.NewReader(data))
+	var segs [][]byte
+	for {
+		if _, err := sr.Next(nil); err == io.EOF {
+			return segs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := io.ReadAll(sr.gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, seg)
+	}
+}
+
+// checkGolden checks that the v2 package data matches want, the package recorded in testdata.
+// The compressed bytes depend on compress/gzip, which may change between Go releases, so the
+// decoded data segment and the metadata are compared, and the hashes and signature of data
+// are checked against its own segments.
+func checkGolden(t *testing.T, data, want []byte) {
+	t.Helper()
+	signer := goldenSigner(t)
+	got, _, err := Verify(bytes.NewReader(data), VerifyOptions{Keys: map[string]*rsa.PublicKey{signer.KeyName(): &signer.Key.PublicKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPkg, err := ReadAPK(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotSegs, wantSegs := decodedSegments(t, data), decodedSegments(t, want)
+	if len(gotSegs) != 3 || len(wantSegs) != 3 {
+		t.Fatalf("%d and %d segments, want signature, control and data", len(gotSegs), len(wantSegs))
+	}
+	if !bytes.Equal(gotSegs[2], wantSegs[2]) {
+		t.Error("decoded data segment differs")
+	}
+	gotInfo, wantInfo := *got.PKGInfo, *wantPkg.PKGInfo
+	gotInfo.DataHash, wantInfo.DataHash = "", ""
+	if !reflect.DeepEqual(gotInfo, wantInfo) {
+		t.Errorf(".PKGINFO = %+v, want %+v", gotInfo, wantInfo)
+	}
+	if !reflect.DeepEqual(got.Scripts, wantPkg.Scripts) {
+		t.Errorf("scripts = %v, want %v", got.Scripts, wantPkg.Scripts)
+	}
+}
+
+// TestAssembleGolden checks that Assemble writes the same package for an fs.FS and for the same
+// tree on disk, and that it matches the package recorded in testdata.
+func TestAssembleGolden(t *testing.T) {
+	s := testSpec()
+	s.Dependencies.Auto.Disabled = false
+	s.Scripts.PostInstall.Run = "echo installed"
+	golden := filepath.Join("testdata", "hello-1.0-r2.apk")
+
+	var fromFS bytes.Buffer
+	if err := Assemble(&fromFS, goldenTree(), s, goldenOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(golden, fromFS.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, fromFS.Bytes(), want)
+
+	dir := t.TempDir()
+	writeTree(t, dir, goldenTree())
+	out := filepath.Join(t.TempDir(), "hello.apk")
+	if err := AssembleAPK(dir, out, s, goldenOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+	fromDir, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromDir, fromFS.Bytes()) {
+		t.Error("AssembleAPK(dir) differs from Assemble(fstest.MapFS)")
+	}
+}
+
+// benchTree returns a tree of files of the given size spread over directories of 100 files,
+// and the total size of the files.
+func benchTree(files, size int) (fstest.MapFS, int64) {
+	tree := fstest.MapFS{}
+	data := pseudoRandom(2, size)
+	for i := range files {
+		name := fmt.Sprintf("usr/share/bench/d%03d/f%05d", i/100, i)
+		tree[name] = &fstest.MapFile{Data: data, Mode: 0o644, ModTime: testEpoch}
+	}
+	return tree, int64(files) * int64(size)
+}
+
+func benchmarkAssemble(b *testing.B, files, size int, format string) {
+	tree, total := benchTree(files, size)
+	s := testSpec()
+	s.Dependencies.Auto.Disabled = false
+	opts := AssembleOptions{Format: format, Arch: "x86_64", SourceDateEpoch: &testEpoch}
+	b.ReportAllocs()
+	b.SetBytes(total)
+	for b.Loop() {
+		if err := Assemble(io.Discard, tree, s, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAssembleManySmallFiles(b *testing.B)   { benchmarkAssemble(b, 5000, 4<<10, FormatV2) }
+func BenchmarkAssembleLargeFiles(b *testing.B)       { benchmarkAssemble(b, 4, 8<<20, FormatV2) }
+func BenchmarkAssembleV3ManySmallFiles(b *testing.B) { benchmarkAssemble(b, 5000, 4<<10, FormatV3) }
+func BenchmarkAssembleV3LargeFiles(b *testing.B)     { benchmarkAssemble(b, 4, 8<<20, FormatV3) }
+
+// openCounter counts the Open calls per name.
+type openCounter struct {
+	fstest.MapFS
+	opens map[string]int
+}
+
+func (c *openCounter) Open(name string) (fs.File, error) {
+	c.opens[name]++
+	return c.MapFS.Open(name)
+}
+
+// TestAssembleReadsFilesOnce checks that each file is opened once, for the data, checksums,
+// arch and dependency detection together.
+func TestAssembleReadsFilesOnce(t *testing.T) {
+	s := testSpec()
+	s.Dependencies.Auto.Disabled = false
+	for _, format := range []string{FormatV2, FormatV3} {
+		t.Run(format, func(t *testing.T) {
+			src := &openCounter{MapFS: goldenTree(), opens: map[string]int{}}
+			var buf bytes.Buffer
+			if err := Assemble(&buf, src, s, AssembleOptions{Format: format, Arch: "x86_64"}); err != nil {
+				t.Fatal(err)
+			}
+			for name, f := range src.MapFS {
+				// v2 packs hardlinks as links, v3 as copies.
+				want := 0
+				if f.Mode.IsRegular() && (f.Sys == nil || format == FormatV3) {
+					want = 1
+				}
+				if got := src.opens[name]; got != want {
+					t.Errorf("%s opened %d times, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
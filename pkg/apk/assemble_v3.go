@@ -0,0 +1,436 @@
+package apk
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// Field indexes of the package schema (apk-tools src/apk_adb.h).
+const (
+	adbiPkgPkginfo          = 1
+	adbiPkgPaths            = 2
+	adbiPkgScripts          = 3
+	adbiPkgTriggers         = 4
+	adbiPkgReplacesPriority = 5
+
+	adbiPIName             = 1
+	adbiPIVersion          = 2
+	adbiPIDescription      = 4
+	adbiPIArch             = 5
+	adbiPILicense          = 6
+	adbiPIOrigin           = 7
+	adbiPIMaintainer       = 8
+	adbiPIURL              = 9
+	adbiPIRepoCommit       = 10
+	adbiPIBuildTime        = 11
+	adbiPIInstalledSize    = 12
+	adbiPIProviderPriority = 14
+	adbiPIDepends          = 15
+	adbiPIProvides         = 16
+	adbiPIReplaces         = 17
+	adbiPIInstallIf        = 18
+	adbiPIMax              = 22
+
+	adbiDepName    = 1
+	adbiDepVersion = 2
+	adbiDepMatch   = 3
+
+	adbiACLMode  = 1
+	adbiACLUser  = 2
+	adbiACLGroup = 3
+
+	adbiFIName   = 1
+	adbiFIACL    = 2
+	adbiFISize   = 3
+	adbiFIMtime  = 4
+	adbiFIHashes = 5
+	adbiFITarget = 6
+
+	adbiDIName  = 1
+	adbiDIACL   = 2
+	adbiDIFiles = 3
+)
+
+// Version match bits of a dependency (APK_VERSION_* in apk-tools).
+const (
+	versionEqual    = 1
+	versionLess     = 2
+	versionGreater  = 4
+	versionFuzzy    = 8
+	versionConflict = 16
+	versionAny      = versionEqual | versionLess | versionGreater
+)
+
+// adbDigestSHA512 is APK_DIGEST_SHA512, the only digest v3 signatures use.
+const adbDigestSHA512 = 4
+
+// v3Dir is a directory of the package and the non-directory entries in it.
+type v3Dir struct {
+	name  string // relative path, "" for the package root
+	h     *tar.Header
+	files []*v3File
+}
+
+type v3File struct {
+	name    string // path in the source
+	h       *tar.Header
+	hash    []byte            // SHA256 of the content (regular files)
+	content *io.SectionReader // copy of the content in the spool (regular files)
+}
+
+// writeV3 writes the v3 package: "ADBd" + raw deflate of the ADB file, which holds the ADB block
+// (package metadata, directories and files with their ACLs and SHA256 hashes, scripts), an
+// optional signature block and one data block per non-empty regular file. Hardlinks are stored
+// as separate files, as apk mkpkg does. The ADB block holds the hashes and precedes the data, so
+// every file is copied to a spool as it is read and the data blocks are written from there.
+func writeV3(out io.Writer, src fs.FS, pkginfo *PKGInfo, scan *fileScan, s *spec.Spec, opts AssembleOptions) error {
+	content, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	buf := make([]byte, 32<<10)
+
+	dirs := map[string]*v3Dir{}
+	links := make(map[fileID]string)
+	var size int64
+	err = fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		h, err := dataHeader(src, name, info, links)
+		if err != nil {
+			return err
+		}
+		opts.normalize(h)
+		if h.Typeflag == tar.TypeLink {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeReg, "", info.Size()
+		}
+		if d.IsDir() {
+			if name == "." {
+				name = ""
+			}
+			dirs[name] = &v3Dir{name: name, h: h}
+			return nil
+		}
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		f := &v3File{name: name, h: h}
+		if h.Typeflag == tar.TypeReg {
+			sum := sha256.New()
+			if f.content, err = content.add(src, name, h.Size, sum, buf); err != nil {
+				return err
+			}
+			f.hash = sum.Sum(nil)
+			size += h.Size
+		}
+		if err := scan.add(h, f.content); err != nil {
+			return err
+		}
+		dirs[parent].files = append(dirs[parent].files, f)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+	if err := scan.complete(pkginfo); err != nil {
+		return err
+	}
+	pkginfo.Size = size
+
+	sorted := make([]*v3Dir, 0, len(dirs))
+	for _, d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	adb, err := buildPackageADB(pkginfo, s, sorted)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(out, "ADBd"); err != nil {
+		return err
+	}
+	zw, err := flate.NewWriter(out, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(zw, adbMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(zw, binary.LittleEndian, uint32(adbSchemaPackage)); err != nil {
+		return err
+	}
+	if err := writeADBBlock(zw, adbBlockADB, adb); err != nil {
+		return err
+	}
+	if opts.Signer != nil {
+		sig, err := adbSignature(opts.Signer, adb)
+		if err != nil {
+			return fmt.Errorf("sign: %w", err)
+		}
+		if err := writeADBBlock(zw, adbBlockSig, sig); err != nil {
+			return err
+		}
+	}
+	for i, d := range sorted {
+		for j, f := range d.files {
+			if f.h.Typeflag != tar.TypeReg || f.h.Size == 0 {
+				continue
+			}
+			if err := writeADBDataBlock(zw, uint32(i+1), uint32(j+1), f, buf); err != nil {
+				return fmt.Errorf("data: %s: %w", f.name, err)
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// buildPackageADB encodes the package object: pkginfo, paths, scripts, triggers.
+func buildPackageADB(pi *PKGInfo, s *spec.Spec, dirs []*v3Dir) ([]byte, error) {
+	w := &adbWriter{}
+	info := make([]adbVal, adbiPIMax-1)
+	set := func(i int, v adbVal) { info[i-1] = v }
+	set(adbiPIName, w.str(pi.PkgName))
+	set(adbiPIVersion, w.str(pi.PkgVer))
+	set(adbiPIDescription, w.str(pi.PkgDesc))
+	set(adbiPIArch, w.str(pi.Arch))
+	set(adbiPILicense, w.str(pi.License))
+	set(adbiPIOrigin, w.str(pi.Origin))
+	set(adbiPIMaintainer, w.str(pi.Maintainer))
+	set(adbiPIURL, w.str(pi.URL))
+	set(adbiPIRepoCommit, w.str(pi.Commit))
+	set(adbiPIBuildTime, w.int(uint64(pi.BuildDate)))
+	set(adbiPIInstalledSize, w.int(uint64(pi.Size)))
+	if pi.ProviderPriority > 0 {
+		set(adbiPIProviderPriority, w.int(uint64(pi.ProviderPriority)))
+	}
+	for _, d := range []struct {
+		field int
+		atoms []string
+	}{
+		{adbiPIDepends, pi.Depends},
+		{adbiPIProvides, pi.Provides},
+		{adbiPIReplaces, pi.Replaces},
+		{adbiPIInstallIf, pi.InstallIf},
+	} {
+		deps, err := adbDependencies(w, d.atoms)
+		if err != nil {
+			return nil, err
+		}
+		set(d.field, deps)
+	}
+
+	paths := make([]adbVal, len(dirs))
+	for i, d := range dirs {
+		files := make([]adbVal, len(d.files))
+		for j, f := range d.files {
+			fields := make([]adbVal, adbiFITarget)
+			fields[adbiFIName-1] = w.str(path.Base(f.h.Name))
+			fields[adbiFIACL-1] = adbACL(w, f.h)
+			fields[adbiFIMtime-1] = w.int(uint64(f.h.ModTime.Unix()))
+			if f.h.Typeflag == tar.TypeReg {
+				fields[adbiFISize-1] = w.int(uint64(f.h.Size))
+				fields[adbiFIHashes-1] = w.blob(f.hash)
+			} else {
+				fields[adbiFITarget-1] = w.blob(fileTarget(f.h))
+			}
+			files[j] = w.object(fields...)
+		}
+		dir := make([]adbVal, adbiDIFiles)
+		dir[adbiDIName-1] = w.str(d.name)
+		dir[adbiDIACL-1] = adbACL(w, d.h)
+		dir[adbiDIFiles-1] = w.array(files)
+		paths[i] = w.object(dir...)
+	}
+
+	scripts := make([]adbVal, 7)
+	for _, f := range scriptFiles(&s.Scripts) {
+		if f.script.Path != "" {
+			return nil, fmt.Errorf("scripts.%s: path %q was not resolved (see ResolveScripts)", f.field, f.script.Path)
+		}
+		if f.script.Run != "" {
+			scripts[adbScriptIndex[f.name]-1] = w.blob(scriptContent(f.script))
+		}
+	}
+	triggers := make([]adbVal, len(pi.Triggers))
+	for i, t := range pi.Triggers {
+		triggers[i] = w.str(t)
+	}
+
+	pkg := make([]adbVal, adbiPkgReplacesPriority)
+	pkg[adbiPkgPkginfo-1] = w.object(info...)
+	pkg[adbiPkgPaths-1] = w.array(paths)
+	pkg[adbiPkgScripts-1] = w.object(scripts...)
+	pkg[adbiPkgTriggers-1] = w.array(triggers)
+	if pi.ReplacesPriority > 0 {
+		pkg[adbiPkgReplacesPriority-1] = w.int(uint64(pi.ReplacesPriority))
+	}
+	return w.finish(w.object(pkg...)), nil
+}
+
+// adbScriptIndex maps control file names to the fields of the scripts object.
+var adbScriptIndex = map[string]int{
+	".trigger":        1,
+	".pre-install":    2,
+	".post-install":   3,
+	".pre-deinstall":  4,
+	".post-deinstall": 5,
+	".pre-upgrade":    6,
+	".post-upgrade":   7,
+}
+
+// adbACL encodes the mode and owner of an entry.
+func adbACL(w *adbWriter, h *tar.Header) adbVal {
+	owner := func(name string) string {
+		if name == "" {
+			return "root"
+		}
+		return name
+	}
+	acl := make([]adbVal, adbiACLGroup)
+	acl[adbiACLMode-1] = w.int(uint64(h.Mode & 0o7777))
+	acl[adbiACLUser-1] = w.str(owner(h.Uname))
+	acl[adbiACLGroup-1] = w.str(owner(h.Gname))
+	return w.object(acl...)
+}
+
+// fileTarget encodes a non-regular file as apk mkpkg does: the file type (S_IFMT bits, u16le)
+// followed by the symlink target or the device number (u64le).
+func fileTarget(h *tar.Header) []byte {
+	var mode uint16
+	switch h.Typeflag {
+	case tar.TypeSymlink:
+		return append(binary.LittleEndian.AppendUint16(nil, 0o120000), h.Linkname...)
+	case tar.TypeChar:
+		mode = 0o020000
+	case tar.TypeBlock:
+		mode = 0o060000
+	case tar.TypeFifo:
+		mode = 0o010000
+	}
+	// Linux dev_t encoding (makedev).
+	major, minor := uint64(h.Devmajor), uint64(h.Devminor)
+	dev := (major&0xfffff000)<<32 | (major&0xfff)<<8 | (minor&0xffffff00)<<12 | minor&0xff
+	return binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint16(nil, mode), dev)
+}
+
+// adbDependencies encodes dependency atoms ([!]name[op version]) as an array of dependency
+// objects sorted by name.
+func adbDependencies(w *adbWriter, atoms []string) (adbVal, error) {
+	type dep struct {
+		name, version string
+		match         int
+	}
+	deps := make([]dep, 0, len(atoms))
+	for _, a := range atoms {
+		d := dep{match: versionAny}
+		if strings.HasPrefix(a, "!") {
+			a = a[1:]
+			d.match |= versionConflict
+		}
+		d.name = a
+		if i := strings.IndexAny(a, "<>=~"); i >= 0 {
+			d.name = a[:i]
+			op := a[i:]
+			d.version = strings.TrimLeft(op, "<>=~")
+			op = op[:len(op)-len(d.version)]
+			d.match &= versionConflict
+			for _, c := range op {
+				switch c {
+				case '<':
+					d.match |= versionLess
+				case '>':
+					d.match |= versionGreater
+				case '=':
+					d.match |= versionEqual
+				case '~':
+					d.match |= versionFuzzy | versionEqual
+				}
+			}
+		}
+		if d.name == "" {
+			return adbNull, fmt.Errorf("invalid dependency %q", a)
+		}
+		deps = append(deps, d)
+	}
+	sort.SliceStable(deps, func(i, j int) bool { return deps[i].name < deps[j].name })
+	vals := make([]adbVal, len(deps))
+	for i, d := range deps {
+		fields := make([]adbVal, adbiDepMatch)
+		fields[adbiDepName-1] = w.str(d.name)
+		if d.match != versionAny {
+			fields[adbiDepVersion-1] = w.str(d.version)
+			if d.match != versionEqual {
+				fields[adbiDepMatch-1] = w.int(uint64(d.match))
+			}
+		}
+		vals[i] = w.object(fields...)
+	}
+	return w.array(vals), nil
+}
+
+// adbSignature returns the payload of a signature block over the ADB block: version 0, SHA512,
+// the key id (first 16 bytes of the SHA512 of the PKCS#1 public key) and the RSA signature of
+// schema || header || key id || SHA512(ADB block).
+func adbSignature(signer Signer, adb []byte) ([]byte, error) {
+	ps, ok := signer.(PublicKeySigner)
+	if !ok {
+		return nil, errors.New("v3 signatures need the signer's public key (PublicKeySigner)")
+	}
+	pub, err := ps.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha512.Sum512(x509.MarshalPKCS1PublicKey(pub))
+	hdr := append([]byte{0, adbDigestSHA512}, keyID[:16]...)
+	md := sha512.Sum512(adb)
+
+	d := sha512.New()
+	binary.Write(d, binary.LittleEndian, uint32(adbSchemaPackage))
+	d.Write(hdr)
+	d.Write(md[:])
+	sig, err := signer.SignDigest(crypto.SHA512, d.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return append(hdr, sig...), nil
+}
+
+// writeADBDataBlock writes the content of f as a data block for paths[pathIdx].files[fileIdx].
+func writeADBDataBlock(w io.Writer, pathIdx, fileIdx uint32, f *v3File, buf []byte) error {
+	pad, err := writeADBBlockHeader(w, adbBlockData, 8+uint64(f.h.Size))
+	if err != nil {
+		return err
+	}
+	idx := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, pathIdx), fileIdx)
+	if _, err := w.Write(idx); err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(w, io.NewSectionReader(f.content, 0, f.h.Size), buf); err != nil {
+		return err
+	}
+	_, err = w.Write(make([]byte, pad))
+	return err
+}
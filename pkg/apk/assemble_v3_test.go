@@ -0,0 +1,206 @@
+package apk
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"slices"
+	"testing"
+)
+
+// adbFile is a v3 package split into its blocks.
+type adbFile struct {
+	schema uint32
+	blocks []adbTestBlock
+}
+
+type adbTestBlock struct {
+	typ     uint32
+	offset  int // offset of the block header in the decompressed file
+	payload []byte
+}
+
+// readADB decompresses a v3 package and splits it into blocks, checking the framing.
+func readADB(t *testing.T, data []byte) *adbFile {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("ADBd")) {
+		t.Fatalf("package starts with %q, want ADBd", data[:min(4, len(data))])
+	}
+	raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(data[4:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(adbMagic)) {
+		t.Fatalf("ADB file starts with %q, want %q", raw[:min(4, len(raw))], adbMagic)
+	}
+	f := &adbFile{schema: binary.LittleEndian.Uint32(raw[4:])}
+	for off := 8; off < len(raw); {
+		if off%adbBlockAlign != 0 {
+			t.Fatalf("block at offset %d is not %d-byte aligned", off, adbBlockAlign)
+		}
+		hdr := binary.LittleEndian.Uint32(raw[off:])
+		typ, size, hdrLen := hdr>>30, uint64(hdr&0x3fffffff), 4
+		if typ == adbBlockExt {
+			typ, size, hdrLen = hdr&0x3fffffff, binary.LittleEndian.Uint64(raw[off+8:]), 16
+		}
+		if off+int(size) > len(raw) {
+			t.Fatalf("block at offset %d overruns the file (size %d)", off, size)
+		}
+		f.blocks = append(f.blocks, adbTestBlock{typ: typ, offset: off, payload: raw[off+hdrLen : off+int(size)]})
+		off += int((size + adbBlockAlign - 1) &^ (adbBlockAlign - 1))
+	}
+	return f
+}
+
+// adbTestReader reads values of an ADB block.
+type adbTestReader []byte
+
+func (r adbTestReader) vector(v adbVal) []adbVal {
+	if v == adbNull {
+		return nil
+	}
+	off := int(v & adbValueMask)
+	n := int(binary.LittleEndian.Uint32(r[off:]))
+	vals := make([]adbVal, n-1)
+	for i := range vals {
+		vals[i] = adbVal(binary.LittleEndian.Uint32(r[off+4+4*i:]))
+	}
+	return vals
+}
+
+func (r adbTestReader) field(obj adbVal, i int) adbVal {
+	fields := r.vector(obj)
+	if i > len(fields) {
+		return adbNull
+	}
+	return fields[i-1]
+}
+
+func (r adbTestReader) str(v adbVal) string {
+	off := int(v & adbValueMask)
+	switch v &^ adbValueMask {
+	case adbTypeBlob8:
+		return string(r[off+1 : off+1+int(r[off])])
+	case adbTypeBlob16:
+		return string(r[off+2 : off+2+int(binary.LittleEndian.Uint16(r[off:]))])
+	case adbTypeBlob32:
+		return string(r[off+4 : off+4+int(binary.LittleEndian.Uint32(r[off:]))])
+	}
+	return ""
+}
+
+func (r adbTestReader) root() adbVal {
+	return adbVal(binary.LittleEndian.Uint32(r[len(r)-4:]))
+}
+
+func TestWriteV3Structure(t *testing.T) {
+	signer := testSigner(t)
+	data := assembleBytes(t, testTree(), testSpec(), AssembleOptions{Format: FormatV3, Signer: signer})
+	f := readADB(t, data)
+	if f.schema != adbSchemaPackage {
+		t.Fatalf("schema = %#x, want %#x (pckg)", f.schema, adbSchemaPackage)
+	}
+
+	// ADB block, signature block, then one data block per non-empty regular file.
+	var types []uint32
+	for _, b := range f.blocks {
+		types = append(types, b.typ)
+	}
+	wantTypes := []uint32{adbBlockADB, adbBlockSig, adbBlockData, adbBlockData}
+	if !slices.Equal(types, wantTypes) {
+		t.Fatalf("block types = %v, want %v", types, wantTypes)
+	}
+
+	adb := adbTestReader(f.blocks[0].payload)
+	info := adb.field(adb.root(), adbiPkgPkginfo)
+	for _, tt := range []struct {
+		field int
+		want  string
+	}{
+		{adbiPIName, "hello"},
+		{adbiPIVersion, "1.0-r2"},
+		{adbiPIDescription, "test package"},
+		{adbiPIArch, ArchNoarch},
+		{adbiPILicense, "MIT"},
+	} {
+		if got := adb.str(adb.field(info, tt.field)); got != tt.want {
+			t.Errorf("pkginfo field %d = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+	var dirs []string
+	for _, d := range adb.vector(adb.field(adb.root(), adbiPkgPaths)) {
+		dirs = append(dirs, adb.str(adb.field(d, adbiDIName)))
+	}
+	wantDirs := []string{"", "usr", "usr/bin", "usr/share", "usr/share/hello"}
+	if !slices.Equal(dirs, wantDirs) {
+		t.Fatalf("paths = %q, want %q", dirs, wantDirs)
+	}
+
+	// Data blocks: path index, file index, content.
+	for i, want := range []struct {
+		path, file uint32
+		content    string
+	}{
+		{3, 1, "#!/bin/sh\necho hello\n"}, // usr/bin/hello
+		{5, 1, "a\n"},                     // usr/share/hello/a.txt
+	} {
+		p := f.blocks[2+i].payload
+		if got := binary.LittleEndian.Uint32(p); got != want.path {
+			t.Errorf("data block %d: path index %d, want %d", i, got, want.path)
+		}
+		if got := binary.LittleEndian.Uint32(p[4:]); got != want.file {
+			t.Errorf("data block %d: file index %d, want %d", i, got, want.file)
+		}
+		if got := string(p[8:]); got != want.content {
+			t.Errorf("data block %d: content %q, want %q", i, got, want.content)
+		}
+	}
+
+	// Signature: version 0, SHA512, key id, RSA signature over schema || header || SHA512(ADB).
+	sig := f.blocks[1].payload
+	if sig[0] != 0 || sig[1] != adbDigestSHA512 {
+		t.Fatalf("signature version %d, digest %d; want 0, %d", sig[0], sig[1], adbDigestSHA512)
+	}
+	pub, err := signer.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := sha512.Sum512(x509.MarshalPKCS1PublicKey(pub))
+	if !bytes.Equal(sig[2:18], keyID[:16]) {
+		t.Errorf("key id %x, want %x", sig[2:18], keyID[:16])
+	}
+	md := sha512.Sum512(f.blocks[0].payload)
+	d := sha512.New()
+	binary.Write(d, binary.LittleEndian, f.schema)
+	d.Write(sig[:18])
+	d.Write(md[:])
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA512, d.Sum(nil), sig[18:]); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestWriteV3NeedsPublicKey(t *testing.T) {
+	var buf bytes.Buffer
+	err := Assemble(&buf, testTree(), testSpec(), AssembleOptions{
+		Format:          FormatV3,
+		Arch:            ArchNoarch,
+		Signer:          keyNameOnly{testSigner(t)},
+		SourceDateEpoch: &testEpoch,
+	})
+	if err == nil {
+		t.Fatal("signed v3 package without a public key")
+	}
+}
+
+// keyNameOnly hides the PublicKey method of a signer.
+type keyNameOnly struct{ s *RSASigner }
+
+func (k keyNameOnly) KeyName() string { return k.s.KeyName() }
+func (k keyNameOnly) SignDigest(h crypto.Hash, digest []byte) ([]byte, error) {
+	return k.s.SignDigest(h, digest)
+}
@@ -0,0 +1,276 @@
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// Directories whose shared objects provide so: names and whose executables provide cmd: names
+// (relative to the package root), as abuild scans them.
+var (
+	libDirs = map[string]bool{"lib": true, "usr/lib": true, "usr/local/lib": true}
+	binDirs = map[string]bool{"bin": true, "sbin": true, "usr/bin": true, "usr/sbin": true, "usr/local/bin": true, "usr/local/sbin": true}
+	pcDirs  = map[string]bool{"usr/lib/pkgconfig": true, "usr/share/pkgconfig": true}
+)
+
+// autoDeps holds the so:, cmd: and pc: entries found in a package's files.
+type autoDeps struct {
+	depends  []string
+	provides []string
+}
+
+// fileScan analyses the files of a package as assembly writes them: ELF files give the package
+// arch (see resolveArch), and unless auto dependencies are disabled, ELF DT_NEEDED become so:
+// dependencies and DT_SONAME of libraries in lib dirs so: provides, executables in bin dirs
+// cmd: provides, and pkg-config files pc: provides (Requires/Requires.private become pc:
+// dependencies). Dependencies satisfied by the package itself are dropped.
+type fileScan struct {
+	want     string // arch from the build platform, "" to detect, ArchNoarch to skip
+	auto     spec.AutoDeps
+	arch     string // arch of the ELF files
+	archFile string // first ELF file
+
+	needed   map[string]struct{}
+	pcNeeded map[string]struct{}
+	sonames  map[string]string // soname -> version
+	soOf     map[string]string // ELF file -> its DT_SONAME, for hardlinks into lib dirs
+	cmds     map[string]struct{}
+	pcs      map[string]string // pc name -> version
+}
+
+func newFileScan(want string, auto spec.AutoDeps) *fileScan {
+	return &fileScan{
+		want:     want,
+		auto:     auto,
+		needed:   map[string]struct{}{},
+		pcNeeded: map[string]struct{}{},
+		sonames:  map[string]string{},
+		soOf:     map[string]string{},
+		cmds:     map[string]struct{}{},
+		pcs:      map[string]string{},
+	}
+}
+
+// add analyses the data entry h. content is the content of regular files (nil otherwise), which
+// is read at offsets: only the headers and the sections that are used.
+func (s *fileScan) add(h *tar.Header, content io.ReaderAt) error {
+	if h.Typeflag == tar.TypeDir {
+		return nil
+	}
+	dir, base := path.Split(h.Name)
+	dir = strings.TrimSuffix(dir, "/")
+
+	if !s.auto.Disabled && binDirs[dir] {
+		// Symlinks count as commands without following them (their targets may be absolute).
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			s.cmds[base] = struct{}{}
+		case tar.TypeReg, tar.TypeLink:
+			if h.Mode&0o111 != 0 {
+				s.cmds[base] = struct{}{}
+			}
+		}
+	}
+	if h.Typeflag == tar.TypeLink {
+		if so, ok := s.soOf[h.Linkname]; ok && !s.auto.Disabled && libDirs[dir] {
+			s.sonames[so] = sharedObjectVersion(base)
+		}
+		return nil
+	}
+	if h.Typeflag != tar.TypeReg {
+		return nil
+	}
+	if !s.auto.Disabled && pcDirs[dir] && strings.HasSuffix(base, ".pc") {
+		version, requires, err := readPkgConfig(io.NewSectionReader(content, 0, h.Size))
+		if err != nil {
+			return fmt.Errorf("%s: %w", h.Name, err)
+		}
+		s.pcs[strings.TrimSuffix(base, ".pc")] = version
+		for _, r := range requires {
+			s.pcNeeded[r] = struct{}{}
+		}
+		return nil
+	}
+
+	f, err := elf.NewFile(content)
+	if err != nil {
+		return nil // not an ELF file
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil
+	}
+	if err := s.addArch(h.Name, f); err != nil {
+		return err
+	}
+	if s.auto.Disabled {
+		return nil
+	}
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil // no dynamic section (static binary)
+	}
+	for _, l := range libs {
+		s.needed[l] = struct{}{}
+	}
+	if names, err := f.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+		s.soOf[h.Name] = names[0]
+		if libDirs[dir] {
+			s.sonames[names[0]] = sharedObjectVersion(base)
+		}
+	}
+	return nil
+}
+
+// complete sets the arch of pi and adds the detected dependencies and providers, once every
+// file was added.
+func (s *fileScan) complete(pi *PKGInfo) error {
+	arch, err := s.resolveArch()
+	if err != nil {
+		return err
+	}
+	pi.Arch = arch
+	if !s.auto.Disabled {
+		applyAutoDeps(pi, s.auto, s.autoDeps(pi.PkgVer))
+	}
+	return nil
+}
+
+// autoDeps returns the so:, cmd: and pc: entries found. pkgver versions the cmd: entries.
+func (s *fileScan) autoDeps(pkgver string) *autoDeps {
+	ad := &autoDeps{}
+	for l := range s.needed {
+		if _, self := s.sonames[l]; !self {
+			ad.depends = append(ad.depends, "so:"+l)
+		}
+	}
+	for r := range s.pcNeeded {
+		if _, self := s.pcs[r]; !self {
+			ad.depends = append(ad.depends, "pc:"+r)
+		}
+	}
+	for so, v := range s.sonames {
+		ad.provides = append(ad.provides, "so:"+so+"="+v)
+	}
+	for c := range s.cmds {
+		ad.provides = append(ad.provides, "cmd:"+c+"="+pkgver)
+	}
+	for pc, v := range s.pcs {
+		if v == "" {
+			ad.provides = append(ad.provides, "pc:"+pc)
+			continue
+		}
+		ad.provides = append(ad.provides, "pc:"+pc+"="+v)
+	}
+	sort.Strings(ad.depends)
+	sort.Strings(ad.provides)
+	return ad
+}
+
+// sharedObjectVersion returns the version suffix of a shared object file name
+// (libfoo.so.1.2.3 -> 1.2.3), or "0" when there is none, as abuild does.
+func sharedObjectVersion(name string) string {
+	if i := strings.Index(name, ".so."); i >= 0 && i+4 < len(name) {
+		return name[i+4:]
+	}
+	return "0"
+}
+
+// readPkgConfig returns the Version and the module names in Requires and Requires.private of
+// a pkg-config file, with ${var} references expanded.
+func readPkgConfig(f io.Reader) (version string, requires []string, err error) {
+	vars := map[string]string{}
+	expand := func(s string) string {
+		return os.Expand(s, func(k string) string { return vars[k] })
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, "=:"); i > 0 {
+			key, val := strings.TrimSpace(line[:i]), expand(strings.TrimSpace(line[i+1:]))
+			if line[i] == '=' {
+				vars[key] = val
+				continue
+			}
+			switch key {
+			case "Version":
+				version = val
+			case "Requires", "Requires.private":
+				requires = append(requires, pkgConfigModules(val)...)
+			}
+		}
+	}
+	return version, requires, sc.Err()
+}
+
+// pkgConfigModules extracts module names from a Requires value ("glib-2.0 >= 2.50, zlib").
+func pkgConfigModules(val string) []string {
+	var mods []string
+	fields := strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "=", "<", ">", "<=", ">=", "!=":
+			i++ // skip the version after an operator
+			continue
+		}
+		// "glib-2.0>=2.50" without spaces
+		if j := strings.IndexAny(fields[i], "<>=!"); j > 0 {
+			mods = append(mods, fields[i][:j])
+			continue
+		}
+		mods = append(mods, fields[i])
+	}
+	return mods
+}
+
+// applyAutoDeps merges the detected entries into pi, dropping names that match the spec's
+// ignore patterns and entries already declared explicitly.
+func applyAutoDeps(pi *PKGInfo, cfg spec.AutoDeps, ad *autoDeps) {
+	ignored := func(entry string) bool {
+		name := atomBaseName(entry)
+		for _, pat := range cfg.Ignore {
+			if ok, _ := path.Match(pat, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	declared := func(list []string, entry string) bool {
+		for _, e := range list {
+			if atomBaseName(e) == atomBaseName(entry) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range ad.depends {
+		if !ignored(d) && !declared(pi.Depends, d) {
+			pi.Depends = append(pi.Depends, d)
+		}
+	}
+	for _, p := range ad.provides {
+		if !ignored(p) && !declared(pi.Provides, p) {
+			pi.Provides = append(pi.Provides, p)
+		}
+	}
+}
+
+// atomBaseName strips the conflict marker and version constraint from a dependency atom.
+func atomBaseName(atom string) string {
+	atom = strings.TrimPrefix(atom, "!")
+	if i := strings.IndexAny(atom, "<>=~"); i >= 0 {
+		atom = atom[:i]
+	}
+	return atom
+}
@@ -0,0 +1,140 @@
+package apk
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testDynELF returns a 64-bit little-endian x86_64 ELF file of type typ with a dynamic section
+// holding soname (if set) and needed.
+func testDynELF(typ elf.Type, soname string, needed ...string) []byte {
+	le := binary.LittleEndian
+	strtab := []byte{0}
+	str := func(s string) uint64 {
+		off := len(strtab)
+		strtab = append(append(strtab, s...), 0)
+		return uint64(off)
+	}
+	var dyn []byte
+	entry := func(tag elf.DynTag, val uint64) {
+		dyn = le.AppendUint64(le.AppendUint64(dyn, uint64(tag)), val)
+	}
+	for _, n := range needed {
+		entry(elf.DT_NEEDED, str(n))
+	}
+	if soname != "" {
+		entry(elf.DT_SONAME, str(soname))
+	}
+	entry(elf.DT_NULL, 0)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	b := testELF(elf.EM_X86_64)
+	le.PutUint16(b[16:], uint16(typ))
+	strOff := uint64(len(b))
+	b = append(b, strtab...)
+	dynOff := uint64(len(b))
+	b = append(b, dyn...)
+	shstrOff := uint64(len(b))
+	b = append(b, shstrtab...)
+	shOff := uint64(len(b))
+	section := func(name uint32, typ elf.SectionType, off, size uint64, link uint32, entsize uint64) {
+		b = le.AppendUint32(b, name)
+		b = le.AppendUint32(b, uint32(typ))
+		b = le.AppendUint64(b, 0) // flags
+		b = le.AppendUint64(b, 0) // addr
+		b = le.AppendUint64(b, off)
+		b = le.AppendUint64(b, size)
+		b = le.AppendUint32(b, link)
+		b = le.AppendUint32(b, 0) // info
+		b = le.AppendUint64(b, 1) // addralign
+		b = le.AppendUint64(b, entsize)
+	}
+	section(0, elf.SHT_NULL, 0, 0, 0, 0)
+	section(1, elf.SHT_STRTAB, strOff, uint64(len(strtab)), 0, 0)
+	section(9, elf.SHT_DYNAMIC, dynOff, uint64(len(dyn)), 1, 16)
+	section(18, elf.SHT_STRTAB, shstrOff, uint64(len(shstrtab)), 0, 0)
+	le.PutUint64(b[40:], shOff) // e_shoff
+	le.PutUint16(b[58:], 64)    // e_shentsize
+	le.PutUint16(b[60:], 4)     // e_shnum
+	le.PutUint16(b[62:], 3)     // e_shstrndx
+	return b
+}
+
+// autoDepsTree has an executable and a library it links against, pkg-config files and a
+// symlinked command.
+func autoDepsTree() fstest.MapFS {
+	return fstest.MapFS{
+		"usr/bin/hello":                      {Data: testDynELF(elf.ET_DYN, "", "libhello.so.1", "libc.musl-x86_64.so.1"), Mode: 0o755},
+		"usr/bin/hi":                         {Data: []byte("hello"), Mode: fs.ModeSymlink | 0o777},
+		"usr/lib/libhello.so.1.2.3":          {Data: testDynELF(elf.ET_DYN, "libhello.so.1", "libz.so.1"), Mode: 0o755},
+		"usr/lib/pkgconfig/hello.pc":         {Data: []byte("prefix=/usr\nversion=1.2.3\n# comment\nName: hello\nVersion: ${version}\nRequires: zlib >= 1.2, glib-2.0>=2.50\nRequires.private: hello-private\n"), Mode: 0o644},
+		"usr/lib/pkgconfig/hello-private.pc": {Data: []byte("Name: hello-private\nRequires:\n"), Mode: 0o644},
+		"usr/share/doc/hello/README":         {Data: []byte("hello\n"), Mode: 0o644},
+	}
+}
+
+func autoDepsInfo(t *testing.T, ignore ...string) *PKGInfo {
+	t.Helper()
+	s := testSpec()
+	s.Dependencies.Auto.Disabled = false
+	s.Dependencies.Auto.Ignore = ignore
+	s.Dependencies.Runtime = []string{"zlib"}
+	data := assembleBytes(t, autoDepsTree(), s, AssembleOptions{Arch: "x86_64"})
+	pi, _, err := ReadPKGInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
+
+func TestAutoDeps(t *testing.T) {
+	pi := autoDepsInfo(t)
+	// libhello.so.1 is provided by the package itself, hello-private.pc too.
+	wantDepends := []string{"zlib", "pc:glib-2.0", "pc:zlib", "so:libc.musl-x86_64.so.1", "so:libz.so.1"}
+	if !slices.Equal(pi.Depends, wantDepends) {
+		t.Errorf("depends = %q, want %q", pi.Depends, wantDepends)
+	}
+	wantProvides := []string{"cmd:hello=1.0-r2", "cmd:hi=1.0-r2", "pc:hello-private", "pc:hello=1.2.3", "so:libhello.so.1=1.2.3"}
+	if !slices.Equal(pi.Provides, wantProvides) {
+		t.Errorf("provides = %q, want %q", pi.Provides, wantProvides)
+	}
+}
+
+func TestAutoDepsIgnore(t *testing.T) {
+	pi := autoDepsInfo(t, "so:libc.musl-*", "cmd:*", "pc:glib-*")
+	for _, entry := range append(pi.Depends, pi.Provides...) {
+		if strings.HasPrefix(entry, "so:libc.musl-") || strings.HasPrefix(entry, "cmd:") || strings.HasPrefix(entry, "pc:glib-") {
+			t.Errorf("ignored entry %q kept", entry)
+		}
+	}
+	if !slices.Contains(pi.Depends, "so:libz.so.1") || !slices.Contains(pi.Provides, "so:libhello.so.1=1.2.3") {
+		t.Errorf("entries not matching the patterns dropped: depends %q, provides %q", pi.Depends, pi.Provides)
+	}
+}
+
+func TestReadPkgConfig(t *testing.T) {
+	version, requires, err := readPkgConfig(strings.NewReader("v=2.0\nmajor=${v}\nVersion: ${major}.1\nRequires: a, b >= 1 c\nRequires.private: d<=2,e\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2.0.1" {
+		t.Errorf("version = %q, want 2.0.1", version)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(requires, want) {
+		t.Errorf("requires = %q, want %q", requires, want)
+	}
+}
+
+func TestSharedObjectVersion(t *testing.T) {
+	for name, want := range map[string]string{"libfoo.so.1.2.3": "1.2.3", "libfoo.so.1": "1", "libfoo.so": "0", "libfoo.so.": "0"} {
+		if got := sharedObjectVersion(name); got != want {
+			t.Errorf("sharedObjectVersion(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
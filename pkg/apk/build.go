@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,10 +18,28 @@ import (
 
 const alpineImage = "alpine:3.23"
 
-// collectPipelinePackages returns a deduplicated list of packages required by pipeline steps (from each pipeline's needs.packages).
+// allSteps returns the main pipeline steps followed by every subpackage's steps.
+func allSteps(s *spec.Spec) []spec.PipelineStep {
+	steps := append([]spec.PipelineStep(nil), s.Pipeline...)
+	for _, sp := range s.Subpackages {
+		steps = append(steps, sp.Pipeline...)
+	}
+	return steps
+}
+
+// collectPipelinePackages returns a deduplicated list of packages required by pipeline steps (from each pipeline's needs.packages)
+// and by the caches they use (e.g. ccache).
 func collectPipelinePackages(s *spec.Spec) ([]string, error) {
 	seen := make(map[string]struct{})
-	for _, step := range s.Pipeline {
+	addCaches := func(names []string) {
+		for _, name := range names {
+			for _, pkg := range caches[name].packages {
+				seen[pkg] = struct{}{}
+			}
+		}
+	}
+	addCaches(s.Cache)
+	for _, step := range allSteps(s) {
 		if step.Uses == "" {
 			continue
 		}
@@ -30,6 +50,7 @@ func collectPipelinePackages(s *spec.Spec) ([]string, error) {
 		for _, pkg := range def.Needs.Packages {
 			seen[pkg] = struct{}{}
 		}
+		addCaches(def.Needs.Caches)
 	}
 	list := make([]string, 0, len(seen))
 	for pkg := range seen {
@@ -40,44 +61,45 @@ func collectPipelinePackages(s *spec.Spec) ([]string, error) {
 }
 
 // buildInstallCommand returns a shell script that configures apk repos (if any) and installs packages from the spec plus all packages needed by pipelines (deduplicated).
-func buildInstallCommand(s *spec.Spec) (string, error) {
+// With the apk cache (spec cache: [apk]) packages are kept in the cache mount instead of being fetched on every build.
+// openssh-client is added when a step forwards the SSH agent.
+// When cross-compiling, the build platform also gets the cross toolchain and the target sysroot is populated (see sysrootInstallCommand).
+func buildInstallCommand(s *spec.Spec, arch BuildArch) (string, error) {
 	pipelinePkgs, err := collectPipelinePackages(s)
 	if err != nil {
 		return "", err
 	}
-	seen := make(map[string]struct{})
-	var all []string
-	for _, p := range s.Environment.Contents.Packages {
-		if _, ok := seen[p]; !ok {
-			seen[p] = struct{}{}
-			all = append(all, p)
-		}
+	all := dedupe(s.Environment.Contents.Packages, pipelinePkgs)
+	if arch.Cross() {
+		all = dedupe(all, crossPackages)
 	}
-	for _, p := range pipelinePkgs {
-		if _, ok := seen[p]; !ok {
-			seen[p] = struct{}{}
-			all = append(all, p)
-		}
+	if usesSSH(s) {
+		all = dedupe(all, sshPackages)
 	}
+	apkCache, _ := specCaches(s)
 	var b strings.Builder
 	b.WriteString("set -e\n")
 	for _, repo := range s.Environment.Contents.Repositories {
 		b.WriteString(fmt.Sprintf("echo %q >> /etc/apk/repositories\n", repo))
 	}
 	if len(all) > 0 {
-		b.WriteString("apk add --no-cache ")
+		fmt.Fprintf(&b, "apk add %s ", apkAddCacheFlag(apkCache))
 		b.WriteString(strings.Join(all, " "))
 		b.WriteString("\n")
 	}
+	if arch.Cross() {
+		b.WriteString(sysrootInstallCommand(s, arch, apkCache))
+	}
 	return b.String(), nil
 }
 
 // validatePipelineStep checks that step.With conforms to the pipeline's input schema.
-func validatePipelineStep(def *PipelineDef, step *spec.PipelineStep, stepIndex int) error {
+// label identifies the step in errors (e.g. "pipeline step 2").
+func validatePipelineStep(def *PipelineDef, step *spec.PipelineStep, label string) error {
 	for key := range step.With {
 		if _, ok := def.Inputs[key]; !ok {
-			return fmt.Errorf("pipeline step %d (%s): unknown input %q (allowed: %s)",
-				stepIndex+1, step.Uses, key, sortedInputNames(def))
+			return fmt.Errorf("%s (%s): unknown input %q (allowed: %s)",
+				label, step.Uses, key, sortedInputNames(def))
 		}
 	}
 	for name, input := range def.Inputs {
@@ -86,7 +108,7 @@ func validatePipelineStep(def *PipelineDef, step *spec.PipelineStep, stepIndex i
 		}
 		raw, ok := step.With[name]
 		if !ok {
-			return fmt.Errorf("pipeline step %d (%s): required input %q is missing", stepIndex+1, step.Uses, name)
+			return fmt.Errorf("%s (%s): required input %q is missing", label, step.Uses, name)
 		}
 		var s string
 		switch v := raw.(type) {
@@ -98,7 +120,7 @@ func validatePipelineStep(def *PipelineDef, step *spec.PipelineStep, stepIndex i
 			s = fmt.Sprint(v)
 		}
 		if strings.TrimSpace(s) == "" {
-			return fmt.Errorf("pipeline step %d (%s): required input %q must not be empty", stepIndex+1, step.Uses, name)
+			return fmt.Errorf("%s (%s): required input %q must not be empty", label, step.Uses, name)
 		}
 	}
 	return nil
@@ -115,11 +137,7 @@ func sortedInputNames(def *PipelineDef) string {
 
 // resolveInputs returns the full substitution map (package/targets/context + inputs) with recursive substitution applied.
 // Uses SubstitutionMap.MutateWith (melange-style) so input values can reference ${{package.name}} etc.
-func resolveInputs(def *PipelineDef, with map[string]interface{}, s *spec.Spec) (map[string]string, error) {
-	sm, err := NewSubstitutionMap(s)
-	if err != nil {
-		return nil, err
-	}
+func resolveInputs(def *PipelineDef, with map[string]interface{}, sm *SubstitutionMap) (map[string]string, error) {
 	withMap := make(map[string]string)
 	for k, v := range def.Inputs {
 		withMap[k] = Substitute(v.Default, sm.Substitutions)
@@ -152,53 +170,170 @@ func substituteScript(script string, inputs map[string]string) string {
 	return script
 }
 
-// buildPipelineScript turns spec.Pipeline into a single shell script.
-func buildPipelineScript(s *spec.Spec) (string, error) {
+// pipelineStep is one resolved pipeline step, run as its own LLB exec so BuildKit caches it and
+// reports its logs and timing separately.
+type pipelineStep struct {
+	name   string // progress name, e.g. "[3/5] cmake/make"
+	script string
+	caches []string // cache mounts: the spec's cache: section plus the pipeline's needs.caches
+	// network: the step may reach the network (fetch pipelines, network: true or ssh: true);
+	// every other step runs with networking disabled.
+	network bool
+	dir     string   // working directory, / unless the step sets working_directory
+	env     []string // the step's environment, KEY=value sorted by key
+	src     spec.PipelineStep
+	// source is set for source pipelines (e.g. git-checkout), which copy a BuildKit source instead of running a script.
+	source *sourceStep
+}
+
+// buildPipelineSteps resolves spec.Pipeline, then each subpackage pipeline, into one script per step.
+// Steps share the filesystem only: each runs in a fresh shell, from / or its working_directory.
+func buildPipelineSteps(s *spec.Spec, arch BuildArch) ([]pipelineStep, error) {
 	if len(s.Pipeline) == 0 {
-		return "", errors.New("pipeline is required and must not be empty")
+		return nil, errors.New("pipeline is required and must not be empty")
 	}
-	var b strings.Builder
-	b.WriteString("set -e\nmkdir -p /pkg\n")
-	for i, step := range s.Pipeline {
+	sm, err := NewSubstitutionMap(s, arch)
+	if err != nil {
+		return nil, err
+	}
+	_, specCacheNames := specCaches(s)
+	steps, err := resolveSteps(s.Pipeline, sm, specCacheNames, "pipeline step", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range s.Subpackages {
+		sub, err := resolveSteps(sp.Pipeline, sm.ForSubpackage(sp.Name), specCacheNames, fmt.Sprintf("subpackage %s: pipeline step", sp.Name), sp.Name+": ")
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, sub...)
+	}
+	for i := range steps {
+		steps[i].name = fmt.Sprintf("[%d/%d] %s", i+1, len(steps), steps[i].name)
+	}
+	return steps, nil
+}
+
+// resolveSteps returns the resolved scripts of steps, named after their pipeline (or first run
+// line) with namePrefix, using specCacheNames and the pipeline's caches. prefix labels steps in errors.
+func resolveSteps(steps []spec.PipelineStep, sm *SubstitutionMap, specCacheNames []string, prefix, namePrefix string) ([]pipelineStep, error) {
+	out := make([]pipelineStep, 0, len(steps))
+	for i, step := range steps {
+		label := fmt.Sprintf("%s %d", prefix, i+1)
 		hasRun := strings.TrimSpace(step.Run) != ""
 		hasUses := step.Uses != ""
 		if hasRun && hasUses {
-			return "", fmt.Errorf("pipeline step %d: cannot set both 'uses' and 'run'", i+1)
+			return nil, fmt.Errorf("%s: cannot set both 'uses' and 'run'", label)
 		}
 		if !hasRun && !hasUses {
-			return "", fmt.Errorf("pipeline step %d: must set either 'uses' or 'run'", i+1)
+			return nil, fmt.Errorf("%s: must set either 'uses' or 'run'", label)
+		}
+		dir, env, err := stepDirEnv(step, sm, label)
+		if err != nil {
+			return nil, err
 		}
 		if hasRun {
-			b.WriteString(step.Run)
-			if !strings.HasSuffix(strings.TrimRight(step.Run, " \t"), "\n") {
-				b.WriteString("\n")
-			}
+			out = append(out, pipelineStep{
+				name:    namePrefix + runStepName(step.Run),
+				script:  stepScript(Substitute(step.Run, sm.Substitutions)),
+				caches:  specCacheNames,
+				network: stepNetwork(step, nil),
+				dir:     dir,
+				env:     env,
+				src:     step,
+			})
 			continue
 		}
 		def, err := getPipeline(step.Uses)
 		if err != nil {
-			return "", fmt.Errorf("pipeline step %d: %w", i+1, err)
+			return nil, fmt.Errorf("%s: %w", label, err)
 		}
-		if err := validatePipelineStep(def, &step, i); err != nil {
-			return "", err
+		if err := validatePipelineStep(def, &step, label); err != nil {
+			return nil, err
 		}
-		inputs, err := resolveInputs(def, step.With, s)
+		inputs, err := resolveInputs(def, step.With, sm)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		slog.Info("pipeline step config", "step", i+1, "uses", step.Uses, "config", inputs)
-		resolved := substituteScript(def.Runs, inputs)
-		b.WriteString(resolved)
-		if !strings.HasSuffix(strings.TrimRight(resolved, " \t"), "\n") {
-			b.WriteString("\n")
+		slog.Info("pipeline step config", "step", label, "uses", step.Uses, "config", inputs)
+		if def.Source != "" {
+			if step.WorkingDirectory != "" || len(step.Environment) > 0 {
+				return nil, fmt.Errorf("%s (%s): working_directory and environment do not apply to source pipelines", label, step.Uses)
+			}
+			src, err := newSourceStep(def, inputs, label)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pipelineStep{name: namePrefix + step.Uses, src: step, source: src})
+			continue
 		}
+		out = append(out, pipelineStep{
+			name:    namePrefix + step.Uses,
+			script:  stepScript(substituteScript(def.Runs, inputs)),
+			caches:  dedupe(specCacheNames, def.Needs.Caches),
+			network: stepNetwork(step, def),
+			dir:     dir,
+			env:     env,
+			src:     step,
+		})
 	}
-	return b.String(), nil
+	return out, nil
+}
+
+// stepDirEnv returns the working directory and environment of step, with substitutions applied.
+// A relative working_directory is relative to /. label identifies the step in errors.
+func stepDirEnv(step spec.PipelineStep, sm *SubstitutionMap, label string) (string, []string, error) {
+	dir := path.Join("/", Substitute(step.WorkingDirectory, sm.Substitutions))
+	keys := make([]string, 0, len(step.Environment))
+	for k := range step.Environment {
+		if !reEnvName.MatchString(k) {
+			return "", nil, fmt.Errorf("%s: invalid environment variable name %q", label, k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, len(keys))
+	for i, k := range keys {
+		env[i] = k + "=" + Substitute(step.Environment[k], sm.Substitutions)
+	}
+	return dir, env, nil
+}
+
+// stepNetwork reports whether step may reach the network: its pipeline (def, nil for run: steps)
+// fetches sources, or the step sets network: true or forwards the SSH agent.
+func stepNetwork(step spec.PipelineStep, def *PipelineDef) bool {
+	return step.Network || step.SSH || (def != nil && def.Needs.Network)
+}
+
+// NoNetworkSuffix ends the name of the pipeline steps that run without network access, so the
+// progress output shows it and the frontend can add a hint to their failures.
+const NoNetworkSuffix = " (no network)"
+
+// stepScript returns the sh -c script of a resolved step.
+func stepScript(resolved string) string {
+	script := "set -e\n" + resolved
+	if !strings.HasSuffix(strings.TrimRight(script, " \t"), "\n") {
+		script += "\n"
+	}
+	return script
+}
+
+// runStepName names an inline step after the first line of its script, shortened for progress output.
+func runStepName(run string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(run), "\n")
+	line = strings.TrimSpace(line)
+	if len(line) > 40 {
+		line = line[:37] + "..."
+	}
+	return "run: " + line
 }
 
 // BuildAPK produces an llb.State that contains built .apk package(s).
 // It uses an Alpine-based environment: installs build deps, runs the pipeline, then creates the .apk via tar (control + data segments).
-func BuildAPK(ctx context.Context, s *spec.Spec, sourceState llb.State, resolver llb.ImageMetaResolver, opts ...llb.ConstraintsOpt) (llb.State, error) {
+// arch gives the platform the pipeline runs on (selected with llb.Platform in opts) and the package arch; when they differ the
+// pipeline cross-compiles with clang against a sysroot of the target's environment packages.
+// sources holds the resolved spec sources by name (see HTTPSourceState); each is placed at /src/<name>.
+func BuildAPK(ctx context.Context, s *spec.Spec, sourceState llb.State, sources map[string]llb.State, resolver llb.ImageMetaResolver, arch BuildArch, opts ...llb.ConstraintsOpt) (llb.State, error) {
 	if s.Name == "" {
 		return llb.Scratch(), errors.New("spec name is required")
 	}
@@ -214,13 +349,42 @@ func BuildAPK(ctx context.Context, s *spec.Spec, sourceState llb.State, resolver
 	if s.License == "" {
 		return llb.Scratch(), errors.New("spec license is required")
 	}
+	if s.Arch != "" && s.Arch != ArchNoarch {
+		return llb.Scratch(), fmt.Errorf("spec arch must be empty or %q, got %q (the arch comes from the build platform)", ArchNoarch, s.Arch)
+	}
+	if err := ValidateFormat(s.Package.Format); err != nil {
+		return llb.Scratch(), fmt.Errorf("package.format: %w", err)
+	}
+	if err := validateDependencies(s); err != nil {
+		return llb.Scratch(), err
+	}
+	if err := validateScripts(s); err != nil {
+		return llb.Scratch(), err
+	}
+	if err := validateSubpackages(s); err != nil {
+		return llb.Scratch(), err
+	}
+	if err := validateCaches(s.Cache, "cache"); err != nil {
+		return llb.Scratch(), err
+	}
+	if err := validateSecrets(s); err != nil {
+		return llb.Scratch(), err
+	}
+	if err := ValidateSources(s); err != nil {
+		return llb.Scratch(), err
+	}
 
-	// Worker: Alpine + environment packages from spec (repositories + packages) + pipeline needs (deduplicated)
-	workerImage := llb.Image(alpineImage, llb.WithCustomName("apk worker base"))
+	// Worker: Alpine + environment packages from spec (repositories + packages) + pipeline needs (deduplicated).
+	// opts may carry llb.Platform, which selects the image variant the pipeline runs in.
+	imageOpts := []llb.ImageOption{llb.WithCustomName("apk worker base")}
 	if resolver != nil {
-		workerImage = llb.Image(alpineImage, llb.WithMetaResolver(resolver), llb.WithCustomName("apk worker base"))
+		imageOpts = append(imageOpts, llb.WithMetaResolver(resolver))
+	}
+	for _, o := range opts {
+		imageOpts = append(imageOpts, o)
 	}
-	installCmd, err := buildInstallCommand(s)
+	workerImage := llb.Image(alpineImage, imageOpts...)
+	installCmd, err := buildInstallCommand(s, arch)
 	if err != nil {
 		return llb.Scratch(), err
 	}
@@ -228,6 +392,9 @@ func BuildAPK(ctx context.Context, s *spec.Spec, sourceState llb.State, resolver
 		llb.Args([]string{"sh", "-c", installCmd}),
 		llb.WithCustomName("install build deps"),
 	}
+	if apkCache, _ := specCaches(s); apkCache {
+		workerRunOpts = append(workerRunOpts, cacheRunOptions([]string{CacheAPK}, arch)...)
+	}
 	for _, o := range opts {
 		workerRunOpts = append(workerRunOpts, o)
 	}
@@ -239,22 +406,83 @@ func BuildAPK(ctx context.Context, s *spec.Spec, sourceState llb.State, resolver
 		opts...,
 	)
 
-	script, err := buildPipelineScript(s)
+	var crossEnvs []string
+	if arch.Cross() {
+		toolchain, err := crossToolchain(arch)
+		if err != nil {
+			return llb.Scratch(), err
+		}
+		workerWithSrc = workerWithSrc.File(
+			llb.Mkdir(path.Dir(crossToolchainFile), 0o755, llb.WithParents(true)).Mkfile(crossToolchainFile, 0o644, toolchain),
+			opts...,
+		)
+		if crossEnvs, err = crossEnv(arch); err != nil {
+			return llb.Scratch(), err
+		}
+	}
+
+	steps, err := buildPipelineSteps(s, arch)
 	if err != nil {
 		return llb.Scratch(), err
 	}
 
-	// Run pipeline; output in /pkg (directory in root so it's part of state)
-	pipelineRunOpts := []llb.RunOption{
-		llb.Args([]string{"sh", "-c", script}),
-		llb.Dir("/"),
-		llb.WithCustomName("run build steps"),
+	// Install destinations exist before the first step; each step then runs on the previous root,
+	// so changing a late step (e.g. strip) reuses the cached results of the earlier ones.
+	mkdirs := llb.Mkdir("/pkg", 0o755)
+	for _, sp := range s.Subpackages {
+		mkdirs = mkdirs.Mkdir(SubpackageDir(sp.Name), 0o755, llb.WithParents(true))
 	}
-	for _, o := range opts {
-		pipelineRunOpts = append(pipelineRunOpts, o)
+	built := workerWithSrc.File(mkdirs, append([]llb.ConstraintsOpt{llb.WithCustomName("create install directories")}, opts...)...)
+	built = placeSources(built, s, sources, opts)
+
+	var stepEnv []llb.RunOption
+	if s.Build.SourceDateEpoch != nil {
+		// Let compilers and tools embed the same timestamps on every build.
+		stepEnv = append(stepEnv, llb.AddEnv("SOURCE_DATE_EPOCH", strconv.FormatInt(*s.Build.SourceDateEpoch, 10)))
+	}
+	for _, kv := range crossEnvs {
+		k, v, _ := strings.Cut(kv, "=")
+		stepEnv = append(stepEnv, llb.AddEnv(k, v))
+	}
+	for _, step := range steps {
+		if step.source != nil {
+			copyOpts := append([]llb.ConstraintsOpt{llb.WithCustomName(step.name)}, opts...)
+			built = built.File(llb.Copy(step.source.state, "/", step.source.dest, &llb.CopyInfo{
+				CopyDirContentsOnly: true,
+				CreateDestPath:      true,
+			}), copyOpts...)
+			continue
+		}
+		name := step.name
+		if !step.network {
+			name += NoNetworkSuffix
+		}
+		runOpts := []llb.RunOption{
+			llb.Args([]string{"sh", "-c", step.script}),
+			llb.Dir(step.dir),
+			llb.WithCustomName(name),
+		}
+		if !step.network {
+			runOpts = append(runOpts, llb.Network(llb.NetModeNone))
+		}
+		runOpts = append(runOpts, stepEnv...)
+		for _, kv := range step.env {
+			k, v, _ := strings.Cut(kv, "=")
+			runOpts = append(runOpts, llb.AddEnv(k, v))
+		}
+		runOpts = append(runOpts, cacheRunOptions(step.caches, arch)...)
+		if slices.Contains(step.caches, cacheCcache) {
+			for _, kv := range crossCcacheEnv(crossEnvs) {
+				k, v, _ := strings.Cut(kv, "=")
+				runOpts = append(runOpts, llb.AddEnv(k, v))
+			}
+		}
+		runOpts = append(runOpts, secretRunOptions(s, step.src)...)
+		for _, o := range opts {
+			runOpts = append(runOpts, o)
+		}
+		built = built.Run(runOpts...).Root()
 	}
-	builtRun := workerWithSrc.Run(pipelineRunOpts...)
-	built := builtRun.Root()
 
 	// Assembly is done in Go outside the container (see frontend: solve → export ref → AssembleAPK → solve write-apk).
 	// Return only the built directory state.
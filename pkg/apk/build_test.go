@@ -0,0 +1,52 @@
+package apk
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// TestPipelineStepsShareNoShell checks that each step is its own script, run from / unless it
+// sets working_directory, so a cd or an export in one step does not reach the next.
+func TestPipelineStepsShareNoShell(t *testing.T) {
+	s := testSpec()
+	s.Pipeline = []spec.PipelineStep{
+		{Run: "cd /src/build\nexport CFLAGS=-O2"},
+		{Run: "make"},
+		{Run: "make install", WorkingDirectory: "src/build", Environment: map[string]string{"CFLAGS": "-O2", "DESTDIR": "${{targets.destdir}}"}},
+	}
+	steps, err := buildPipelineSteps(s, BuildArch{Build: "x86_64", Target: "x86_64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("%d steps, want 3", len(steps))
+	}
+	if strings.Contains(steps[1].script, "cd ") || strings.Contains(steps[1].script, "CFLAGS") {
+		t.Errorf("second step script %q carries the first step", steps[1].script)
+	}
+	for i, want := range []struct {
+		name string
+		dir  string
+		env  []string
+	}{
+		{"[1/3] run: cd /src/build", "/", []string{}},
+		{"[2/3] run: make", "/", []string{}},
+		{"[3/3] run: make install", "/src/build", []string{"CFLAGS=-O2", "DESTDIR=" + TargetsDestdir}},
+	} {
+		st := steps[i]
+		if st.name != want.name || st.dir != want.dir || !slices.Equal(st.env, want.env) {
+			t.Errorf("step %d: name %q, dir %q, env %q; want %q, %q, %q", i+1, st.name, st.dir, st.env, want.name, want.dir, want.env)
+		}
+	}
+}
+
+func TestPipelineStepEnvironmentName(t *testing.T) {
+	s := testSpec()
+	s.Pipeline = []spec.PipelineStep{{Run: "make", Environment: map[string]string{"BAD-NAME": "1"}}}
+	if _, err := buildPipelineSteps(s, BuildArch{Build: "x86_64", Target: "x86_64"}); err == nil {
+		t.Fatal("invalid environment variable name accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package apk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const (
+	// alpinePath is PATH in alpineImage; steps using ccache get the ccache compiler links first.
+	alpinePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// CacheAPK is the package cache of apk add. Unlike the other caches it applies to the
+	// installation of the build environment (and the cross sysroot), not to pipeline steps.
+	CacheAPK    = "apk"
+	apkCacheDir = "/var/cache/apk"
+
+	cacheCcache = "ccache"
+)
+
+// cacheDef is a BuildKit cache mount that specs (cache:) and pipelines (needs.caches) select by name.
+type cacheDef struct {
+	dir     string
+	sharing llb.CacheMountSharingMode
+	// perArch gives each target arch its own cache, so that locked caches do not serialize the
+	// builds of different platforms.
+	perArch bool
+	// env is exported to the steps using the cache, packages are installed in the build environment.
+	env      []string
+	packages []string
+}
+
+// caches are the known cache mounts. Cache contents are keyed by the tools themselves (compiler
+// arguments, module versions, ...), so one cache is shared by every build and platform; the apk
+// cache is locked while apk runs and is kept per arch instead.
+var caches = map[string]cacheDef{
+	CacheAPK: {dir: apkCacheDir, sharing: llb.CacheMountLocked, perArch: true},
+	cacheCcache: {
+		dir:      "/root/.cache/ccache",
+		sharing:  llb.CacheMountShared,
+		env:      []string{"CCACHE_DIR=/root/.cache/ccache", "PATH=/usr/lib/ccache/bin:" + alpinePath},
+		packages: []string{"ccache"},
+	},
+	"go-build": {dir: "/root/.cache/go-build", sharing: llb.CacheMountShared, env: []string{"GOCACHE=/root/.cache/go-build"}},
+	"go-mod":   {dir: "/root/go/pkg/mod", sharing: llb.CacheMountShared, env: []string{"GOMODCACHE=/root/go/pkg/mod"}},
+	"cargo":    {dir: "/root/.cargo/registry", sharing: llb.CacheMountShared},
+}
+
+// validateCaches checks that names are known caches. label identifies the list in errors.
+func validateCaches(names []string, label string) error {
+	for _, name := range names {
+		if _, ok := caches[name]; !ok {
+			return fmt.Errorf("%s: unknown cache %q (allowed: %s)", label, name, knownCacheNames())
+		}
+	}
+	return nil
+}
+
+func knownCacheNames() string {
+	names := make([]string, 0, len(caches))
+	for k := range caches {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// specCaches reports whether the spec enables the apk cache, and returns the other caches of its
+// cache: section, which every pipeline step uses.
+func specCaches(s *spec.Spec) (bool, []string) {
+	var apkCache bool
+	var names []string
+	for _, name := range s.Cache {
+		if name == CacheAPK {
+			apkCache = true
+			continue
+		}
+		names = append(names, name)
+	}
+	return apkCache, names
+}
+
+// apkAddCacheFlag is the apk add flag for the package cache: the cache mount when enabled,
+// otherwise no cache so nothing is left in the build environment.
+func apkAddCacheFlag(cached bool) string {
+	if cached {
+		return "--cache-dir " + apkCacheDir
+	}
+	return "--no-cache"
+}
+
+// cacheRunOptions returns the mounts and environment of the named caches for a build of arch.
+func cacheRunOptions(names []string, arch BuildArch) []llb.RunOption {
+	var opts []llb.RunOption
+	for _, name := range names {
+		c := caches[name]
+		id := "apkbuild-" + name
+		if c.perArch {
+			id += "-" + arch.Target
+		}
+		opts = append(opts, llb.AddMount(c.dir, llb.Scratch(), llb.AsPersistentCacheDir(id, c.sharing)))
+		for _, kv := range c.env {
+			k, v, _ := strings.Cut(kv, "=")
+			opts = append(opts, llb.AddEnv(k, v))
+		}
+	}
+	return opts
+}
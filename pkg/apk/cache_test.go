@@ -0,0 +1,124 @@
+package apk
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// execOp marshals a run of opts and returns its exec op.
+func execOp(t *testing.T, opts ...llb.RunOption) *pb.ExecOp {
+	t.Helper()
+	opts = append(opts, llb.Args([]string{"true"}))
+	def, err := llb.Image(alpineImage).Run(opts...).Root().Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatal(err)
+		}
+		if e := op.GetExec(); e != nil {
+			return e
+		}
+	}
+	t.Fatal("no exec op")
+	return nil
+}
+
+// cacheMounts returns the cache mounts of e by destination.
+func cacheMounts(e *pb.ExecOp) map[string]*pb.CacheOpt {
+	mounts := map[string]*pb.CacheOpt{}
+	for _, m := range e.Mounts {
+		if m.MountType == pb.MountType_CACHE {
+			mounts[m.Dest] = m.CacheOpt
+		}
+	}
+	return mounts
+}
+
+func TestCacheRunOptions(t *testing.T) {
+	arch := BuildArch{Build: "x86_64", Target: "aarch64"}
+	e := execOp(t, cacheRunOptions([]string{CacheAPK, cacheCcache, "go-build", "go-mod", "cargo"}, arch)...)
+	want := map[string]*pb.CacheOpt{
+		apkCacheDir:             {ID: "apkbuild-apk-aarch64", Sharing: pb.CacheSharingOpt_LOCKED},
+		"/root/.cache/ccache":   {ID: "apkbuild-ccache", Sharing: pb.CacheSharingOpt_SHARED},
+		"/root/.cache/go-build": {ID: "apkbuild-go-build", Sharing: pb.CacheSharingOpt_SHARED},
+		"/root/go/pkg/mod":      {ID: "apkbuild-go-mod", Sharing: pb.CacheSharingOpt_SHARED},
+		"/root/.cargo/registry": {ID: "apkbuild-cargo", Sharing: pb.CacheSharingOpt_SHARED},
+	}
+	got := cacheMounts(e)
+	if len(got) != len(want) {
+		t.Errorf("cache mounts %v, want %d", got, len(want))
+	}
+	for dir, w := range want {
+		if g, ok := got[dir]; !ok || g.ID != w.ID || g.Sharing != w.Sharing {
+			t.Errorf("cache mount %s = %v, want %v", dir, g, w)
+		}
+	}
+	for _, kv := range []string{
+		"CCACHE_DIR=/root/.cache/ccache",
+		"PATH=/usr/lib/ccache/bin:" + alpinePath,
+		"GOCACHE=/root/.cache/go-build",
+		"GOMODCACHE=/root/go/pkg/mod",
+	} {
+		if !slices.Contains(e.Meta.Env, kv) {
+			t.Errorf("env %q does not have %s", e.Meta.Env, kv)
+		}
+	}
+}
+
+func TestCacheRunOptionsPerArch(t *testing.T) {
+	// The apk cache is locked while apk runs: each target arch has its own, other caches are shared.
+	ids := func(target string) []string {
+		var ids []string
+		for _, c := range cacheMounts(execOp(t, cacheRunOptions([]string{CacheAPK, "go-mod"}, BuildArch{Build: "x86_64", Target: target})...)) {
+			ids = append(ids, c.ID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	if got, want := ids("x86_64"), []string{"apkbuild-apk-x86_64", "apkbuild-go-mod"}; !slices.Equal(got, want) {
+		t.Errorf("x86_64 cache ids = %q, want %q", got, want)
+	}
+	if got, want := ids("riscv64"), []string{"apkbuild-apk-riscv64", "apkbuild-go-mod"}; !slices.Equal(got, want) {
+		t.Errorf("riscv64 cache ids = %q, want %q", got, want)
+	}
+}
+
+func TestValidateCaches(t *testing.T) {
+	if err := validateCaches([]string{CacheAPK, cacheCcache, "go-build", "go-mod", "cargo"}, "cache"); err != nil {
+		t.Fatal(err)
+	}
+	err := validateCaches([]string{"go-mod", "npm"}, "cache")
+	if err == nil || !strings.Contains(err.Error(), `cache: unknown cache "npm" (allowed: apk, cargo, ccache, go-build, go-mod)`) {
+		t.Errorf("got %v, want an unknown cache error listing the allowed caches", err)
+	}
+
+	// BuildAPK rejects the spec before making any LLB.
+	s := testSpec()
+	s.URL = "https://example.com"
+	s.Cache = []string{"go-mod", "pip"}
+	_, err = BuildAPK(context.Background(), s, llb.Scratch(), nil, nil, BuildArch{Build: "x86_64", Target: "x86_64"})
+	if err == nil || !strings.Contains(err.Error(), `unknown cache "pip"`) {
+		t.Errorf("BuildAPK: got %v, want an unknown cache error", err)
+	}
+}
+
+func TestSpecCaches(t *testing.T) {
+	s := testSpec()
+	s.Cache = []string{"go-mod", CacheAPK, cacheCcache}
+	apkCache, names := specCaches(s)
+	if !apkCache || !slices.Equal(names, []string{"go-mod", cacheCcache}) {
+		t.Errorf("specCaches = %v, %q; want true, [go-mod ccache]", apkCache, names)
+	}
+	s.Cache = nil
+	if apkCache, names := specCaches(s); apkCache || names != nil {
+		t.Errorf("specCaches without caches = %v, %q", apkCache, names)
+	}
+}
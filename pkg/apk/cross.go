@@ -0,0 +1,158 @@
+package apk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// BuildArch is the pair of Alpine architectures of a build: the pipeline runs on Build and the
+// packages are for Target. They differ only when cross-compiling (spec build.cross); emulated
+// builds run on the target itself.
+type BuildArch struct {
+	Build  string
+	Target string
+}
+
+// Cross reports whether the build cross-compiles.
+func (a BuildArch) Cross() bool { return a.Build != a.Target }
+
+const (
+	// CrossSysroot holds the target's environment packages when cross-compiling (${{host.sysroot}}).
+	CrossSysroot = "/workspace/sysroot"
+	// crossToolchainFile is the CMake toolchain file of cross builds (exported as CMAKE_TOOLCHAIN_FILE).
+	crossToolchainFile = "/workspace/cross/toolchain.cmake"
+)
+
+var (
+	// crossPackages are installed on the build platform: clang and lld target any arch, llvm
+	// provides arch-independent binutils (llvm-ar, llvm-strip, ...).
+	crossPackages = []string{"clang", "lld", "llvm"}
+	// crossSysrootPackages are always installed in the sysroot: libc, libgcc, libstdc++ and the
+	// GCC crt files clang links against.
+	crossSysrootPackages = []string{"build-base"}
+)
+
+// archSubstitutions returns the ${{build.*}}, ${{target.*}} and ${{host.*}} variables of arch.
+// As in GNU terms, host is the system the packaged binaries run on.
+func archSubstitutions(arch BuildArch) (map[string]string, error) {
+	build, err := GNUTriplet(arch.Build)
+	if err != nil {
+		return nil, err
+	}
+	host, err := GNUTriplet(arch.Target)
+	if err != nil {
+		return nil, err
+	}
+	sysroot := "/"
+	if arch.Cross() {
+		sysroot = CrossSysroot
+	}
+	return map[string]string{
+		SubstitutionBuildArch:       arch.Build,
+		SubstitutionBuildTripletGNU: build,
+		SubstitutionTargetArch:      arch.Target,
+		SubstitutionHostTripletGNU:  host,
+		SubstitutionHostSysroot:     sysroot,
+	}, nil
+}
+
+// sysrootInstallCommand returns the script that installs the target's environment packages into
+// CrossSysroot with apk --root --arch (no scripts run, target keys from alpine-keys), then
+// makes absolute symlinks point inside the sysroot so the linker can follow them. apkCache
+// selects the apk cache mount, which holds packages of any arch.
+func sysrootInstallCommand(s *spec.Spec, arch BuildArch, apkCache bool) string {
+	pkgs := dedupe(crossSysrootPackages, s.Environment.Contents.Packages)
+	var b strings.Builder
+	fmt.Fprintf(&b, "apk add %s --no-scripts --initdb --root %s --arch %s --keys-dir /usr/share/apk/keys/%s --repositories-file /etc/apk/repositories %s\n",
+		apkAddCacheFlag(apkCache), CrossSysroot, arch.Target, arch.Target, strings.Join(pkgs, " "))
+	fmt.Fprintf(&b, "find %s -type l | while read -r l; do t=$(readlink \"$l\"); case \"$t\" in /*) ln -sfn \"%s$t\" \"$l\";; esac; done\n", CrossSysroot, CrossSysroot)
+	return b.String()
+}
+
+// crossEnv returns the environment of a cross-compiling pipeline: compilers and binutils for the
+// target, pkg-config restricted to the sysroot, and abuild's CBUILD/CHOST.
+func crossEnv(arch BuildArch) ([]string, error) {
+	subs, err := archSubstitutions(arch)
+	if err != nil {
+		return nil, err
+	}
+	host := subs[SubstitutionHostTripletGNU]
+	compile := fmt.Sprintf("--target=%s --sysroot=%s", host, CrossSysroot)
+	return []string{
+		"CBUILD=" + subs[SubstitutionBuildTripletGNU],
+		"CHOST=" + host,
+		"CC=clang " + compile,
+		"CXX=clang++ " + compile,
+		"LDFLAGS=-fuse-ld=lld",
+		"AR=llvm-ar",
+		"NM=llvm-nm",
+		"RANLIB=llvm-ranlib",
+		"STRIP=llvm-strip",
+		"OBJCOPY=llvm-objcopy",
+		"OBJDUMP=llvm-objdump",
+		"READELF=llvm-readelf",
+		"PKG_CONFIG_SYSROOT_DIR=" + CrossSysroot,
+		"PKG_CONFIG_LIBDIR=" + CrossSysroot + "/usr/lib/pkgconfig:" + CrossSysroot + "/usr/share/pkgconfig",
+		"CMAKE_TOOLCHAIN_FILE=" + crossToolchainFile,
+	}, nil
+}
+
+// crossCcacheEnv returns the compilers of crossEnv run through ccache, for the steps that use
+// the ccache cache: CC and CXX carry the target flags, so they are not reached through the
+// ccache links in PATH, and CMake takes its compilers from the toolchain file.
+func crossCcacheEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		if k, v, _ := strings.Cut(kv, "="); k == "CC" || k == "CXX" {
+			out = append(out, k+"=ccache "+v)
+		}
+	}
+	if len(out) > 0 {
+		out = append(out, "CMAKE_C_COMPILER_LAUNCHER=ccache", "CMAKE_CXX_COMPILER_LAUNCHER=ccache")
+	}
+	return out
+}
+
+// crossToolchain returns the CMake toolchain file for arch: clang for the target triplet, the
+// sysroot, and find_* looking up libraries and headers in the sysroot only.
+func crossToolchain(arch BuildArch) ([]byte, error) {
+	host, err := GNUTriplet(arch.Target)
+	if err != nil {
+		return nil, err
+	}
+	processor, _, _ := strings.Cut(host, "-")
+	var b strings.Builder
+	b.WriteString("set(CMAKE_SYSTEM_NAME Linux)\n")
+	fmt.Fprintf(&b, "set(CMAKE_SYSTEM_PROCESSOR %s)\n", processor)
+	fmt.Fprintf(&b, "set(CMAKE_SYSROOT %s)\n", CrossSysroot)
+	for _, lang := range []struct{ name, compiler string }{{"C", "clang"}, {"CXX", "clang++"}, {"ASM", "clang"}} {
+		fmt.Fprintf(&b, "set(CMAKE_%s_COMPILER %s)\n", lang.name, lang.compiler)
+		fmt.Fprintf(&b, "set(CMAKE_%s_COMPILER_TARGET %s)\n", lang.name, host)
+	}
+	b.WriteString("set(CMAKE_AR llvm-ar)\nset(CMAKE_RANLIB llvm-ranlib)\nset(CMAKE_STRIP llvm-strip)\n")
+	for _, kind := range []string{"EXE", "SHARED", "MODULE"} {
+		fmt.Fprintf(&b, "set(CMAKE_%s_LINKER_FLAGS_INIT -fuse-ld=lld)\n", kind)
+	}
+	b.WriteString("set(CMAKE_FIND_ROOT_PATH_MODE_PROGRAM NEVER)\n")
+	for _, mode := range []string{"LIBRARY", "INCLUDE", "PACKAGE"} {
+		fmt.Fprintf(&b, "set(CMAKE_FIND_ROOT_PATH_MODE_%s ONLY)\n", mode)
+	}
+	return []byte(b.String()), nil
+}
+
+// dedupe concatenates lists, keeping the first occurrence of each entry.
+func dedupe(lists ...[]string) []string {
+	seen := make(map[string]struct{})
+	var out []string
+	for _, l := range lists {
+		for _, v := range l {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
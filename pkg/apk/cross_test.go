@@ -0,0 +1,109 @@
+package apk
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testCrossArch = BuildArch{Build: "x86_64", Target: "aarch64"}
+
+func TestCrossEnv(t *testing.T) {
+	env, err := crossEnv(testCrossArch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		got[k] = v
+	}
+	for k, want := range map[string]string{
+		"CBUILD":                 "x86_64-alpine-linux-musl",
+		"CHOST":                  "aarch64-alpine-linux-musl",
+		"CC":                     "clang --target=aarch64-alpine-linux-musl --sysroot=" + CrossSysroot,
+		"CXX":                    "clang++ --target=aarch64-alpine-linux-musl --sysroot=" + CrossSysroot,
+		"LDFLAGS":                "-fuse-ld=lld",
+		"STRIP":                  "llvm-strip",
+		"OBJCOPY":                "llvm-objcopy",
+		"PKG_CONFIG_SYSROOT_DIR": CrossSysroot,
+		"PKG_CONFIG_LIBDIR":      CrossSysroot + "/usr/lib/pkgconfig:" + CrossSysroot + "/usr/share/pkgconfig",
+		"CMAKE_TOOLCHAIN_FILE":   crossToolchainFile,
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %q, want %q", k, got[k], want)
+		}
+	}
+
+	ccache := crossCcacheEnv(env)
+	want := []string{
+		"CC=ccache clang --target=aarch64-alpine-linux-musl --sysroot=" + CrossSysroot,
+		"CXX=ccache clang++ --target=aarch64-alpine-linux-musl --sysroot=" + CrossSysroot,
+		"CMAKE_C_COMPILER_LAUNCHER=ccache",
+		"CMAKE_CXX_COMPILER_LAUNCHER=ccache",
+	}
+	if !slices.Equal(ccache, want) {
+		t.Errorf("ccache env = %q, want %q", ccache, want)
+	}
+	if native := crossCcacheEnv(nil); len(native) != 0 {
+		t.Errorf("ccache env of a native build = %q, want none", native)
+	}
+}
+
+func TestCrossToolchain(t *testing.T) {
+	data, err := crossToolchain(testCrossArch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, want := range []string{
+		"set(CMAKE_SYSTEM_NAME Linux)",
+		"set(CMAKE_SYSTEM_PROCESSOR aarch64)",
+		"set(CMAKE_SYSROOT " + CrossSysroot + ")",
+		"set(CMAKE_C_COMPILER clang)",
+		"set(CMAKE_C_COMPILER_TARGET aarch64-alpine-linux-musl)",
+		"set(CMAKE_CXX_COMPILER clang++)",
+		"set(CMAKE_ASM_COMPILER_TARGET aarch64-alpine-linux-musl)",
+		"set(CMAKE_STRIP llvm-strip)",
+		"set(CMAKE_SHARED_LINKER_FLAGS_INIT -fuse-ld=lld)",
+		"set(CMAKE_FIND_ROOT_PATH_MODE_PROGRAM NEVER)",
+		"set(CMAKE_FIND_ROOT_PATH_MODE_LIBRARY ONLY)",
+		"set(CMAKE_FIND_ROOT_PATH_MODE_INCLUDE ONLY)",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("toolchain file has no %q:\n%s", want, data)
+		}
+	}
+	if _, err := crossToolchain(BuildArch{Build: "x86_64", Target: "m68k"}); err == nil {
+		t.Error("toolchain for an arch without GNU triplet")
+	}
+}
+
+func TestArchSubstitutions(t *testing.T) {
+	for _, tt := range []struct {
+		arch    BuildArch
+		sysroot string
+	}{
+		{BuildArch{Build: "aarch64", Target: "aarch64"}, "/"},
+		{testCrossArch, CrossSysroot},
+	} {
+		subs, err := archSubstitutions(tt.arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subs[SubstitutionBuildArch] != tt.arch.Build || subs[SubstitutionTargetArch] != tt.arch.Target || subs[SubstitutionHostSysroot] != tt.sysroot {
+			t.Errorf("%+v: substitutions %v", tt.arch, subs)
+		}
+	}
+}
+
+func TestSysrootInstallCommand(t *testing.T) {
+	s := testSpec()
+	s.Environment.Contents.Packages = []string{"zlib-dev", "build-base"}
+	cmd := sysrootInstallCommand(s, testCrossArch, true)
+	want := "apk add --cache-dir /var/cache/apk --no-scripts --initdb --root " + CrossSysroot +
+		" --arch aarch64 --keys-dir /usr/share/apk/keys/aarch64 --repositories-file /etc/apk/repositories build-base zlib-dev\n"
+	if first, _, _ := strings.Cut(cmd, "\n"); first+"\n" != want {
+		t.Errorf("install line = %q, want %q", first, want)
+	}
+}
@@ -0,0 +1,62 @@
+package apk
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// apk dependency atoms: [!]name[@tag][op version], where name may carry a so:, cmd: or pc: prefix.
+const (
+	atomName    = `(?:(?:so|cmd|pc):)?[A-Za-z0-9_][A-Za-z0-9_.+\-]*`
+	atomVersion = `[0-9]+(?:\.[0-9]+)*[a-z]?(?:_(?:alpha|beta|pre|rc|cvs|svn|git|hg|p)[0-9]*)*(?:-r[0-9]+)?`
+)
+
+var (
+	reDependAtom  = regexp.MustCompile(`^!?` + atomName + `(?:@[A-Za-z0-9_\-]+)?(?:(?:<=|>=|=~|><|=|<|>|~)` + atomVersion + `)?$`)
+	reProvideAtom = regexp.MustCompile(`^` + atomName + `(?:=` + atomVersion + `)?$`)
+	rePackageName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+\-]*$`)
+)
+
+// validateDependencies checks the dependency atoms in s.Dependencies so mistakes fail the build
+// instead of producing a package apk refuses to install.
+func validateDependencies(s *spec.Spec) error {
+	d := s.Dependencies
+	check := func(field string, list []string, re *regexp.Regexp, hint string) error {
+		for _, a := range list {
+			if !re.MatchString(a) {
+				return fmt.Errorf("dependencies.%s: invalid entry %q (%s)", field, a, hint)
+			}
+		}
+		return nil
+	}
+	if err := check("runtime", d.Runtime, reDependAtom, "expected e.g. foo, foo>=1.2, !bar, so:libfoo.so.1, cmd:foo, pc:foo"); err != nil {
+		return err
+	}
+	for _, c := range d.Conflicts {
+		if !reDependAtom.MatchString("!" + strings.TrimPrefix(c, "!")) {
+			return fmt.Errorf("dependencies.conflicts: invalid entry %q (expected e.g. foo or foo<2)", c)
+		}
+	}
+	if err := check("provides", d.Provides, reProvideAtom, "expected name or name=version, e.g. so:libfoo.so.1=1.2"); err != nil {
+		return err
+	}
+	if err := check("replaces", d.Replaces, rePackageName, "expected a package name"); err != nil {
+		return err
+	}
+	if err := check("install_if", d.InstallIf, reDependAtom, "expected dependency atoms, e.g. foo bash-completion"); err != nil {
+		return err
+	}
+	for _, pat := range d.Auto.Ignore {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("dependencies.auto.ignore: invalid pattern %q: %w", pat, err)
+		}
+	}
+	if d.ProviderPriority < 0 || d.ReplacesPriority < 0 {
+		return fmt.Errorf("dependencies: provider_priority and replaces_priority must not be negative")
+	}
+	return nil
+}
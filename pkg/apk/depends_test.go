@@ -0,0 +1,52 @@
+package apk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		deps    spec.Dependencies
+		wantErr string // "" when valid
+	}{
+		{"plain", spec.Dependencies{Runtime: []string{"musl", "busybox"}}, ""},
+		{"conflict atom", spec.Dependencies{Runtime: []string{"!hello-legacy"}}, ""},
+		{"prefixed names", spec.Dependencies{Runtime: []string{"so:libc.musl-x86_64.so.1", "cmd:sh", "pc:zlib"}}, ""},
+		{"operators", spec.Dependencies{Runtime: []string{"a>=1.2", "b<2", "c<=3.0_rc1", "d>1", "e=1.0-r2", "f~1.2", "g=~1", "h><1"}}, ""},
+		{"repository tag", spec.Dependencies{Runtime: []string{"foo@edge>=1.2"}}, ""},
+		{"version suffixes", spec.Dependencies{Runtime: []string{"foo=1.2.3a_alpha2_p1-r0"}}, ""},
+		{"space in atom", spec.Dependencies{Runtime: []string{"foo >= 1.2"}}, "dependencies.runtime"},
+		{"unknown prefix", spec.Dependencies{Runtime: []string{"lib:foo"}}, "dependencies.runtime"},
+		{"operator without version", spec.Dependencies{Runtime: []string{"foo>="}}, "dependencies.runtime"},
+		{"bad version", spec.Dependencies{Runtime: []string{"foo=v1"}}, "dependencies.runtime"},
+		{"empty", spec.Dependencies{Runtime: []string{""}}, "dependencies.runtime"},
+		{"conflicts with and without !", spec.Dependencies{Conflicts: []string{"foo", "!bar<2"}}, ""},
+		{"double negation", spec.Dependencies{Conflicts: []string{"!!foo"}}, "dependencies.conflicts"},
+		{"provides", spec.Dependencies{Provides: []string{"greeter", "so:libfoo.so.1=1.2", "cmd:hello=1.0-r2"}}, ""},
+		{"provides with range", spec.Dependencies{Provides: []string{"greeter>=1"}}, "dependencies.provides"},
+		{"provides conflict", spec.Dependencies{Provides: []string{"!greeter"}}, "dependencies.provides"},
+		{"replaces", spec.Dependencies{Replaces: []string{"hello-legacy"}}, ""},
+		{"replaces with version", spec.Dependencies{Replaces: []string{"hello-legacy<2"}}, "dependencies.replaces"},
+		{"install_if", spec.Dependencies{InstallIf: []string{"hello", "bash-completion"}}, ""},
+		{"install_if invalid", spec.Dependencies{InstallIf: []string{"hello bash"}}, "dependencies.install_if"},
+		{"ignore pattern", spec.Dependencies{Auto: spec.AutoDeps{Ignore: []string{"so:libfoo*"}}}, ""},
+		{"bad ignore pattern", spec.Dependencies{Auto: spec.AutoDeps{Ignore: []string{"so:[libfoo"}}}, "dependencies.auto.ignore"},
+		{"negative priority", spec.Dependencies{ProviderPriority: -1}, "must not be negative"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSpec()
+			s.Dependencies = tt.deps
+			err := validateDependencies(s)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package apk
+
+import "os"
+
+// fileID identifies a file on disk so hardlinks to it can be recognised.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardlinkID reports no hardlinks on platforms without inode information.
+func hardlinkID(os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
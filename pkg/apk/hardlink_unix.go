@@ -0,0 +1,22 @@
+//go:build unix
+
+package apk
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file on disk so hardlinks to it can be recognised.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardlinkID returns the inode identity of info if it has more than one link.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
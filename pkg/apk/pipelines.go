@@ -43,6 +43,10 @@ func (i *InputDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
 // PipelineNeeds declares what a pipeline needs (e.g. packages to install in the build environment).
 type PipelineNeeds struct {
 	Packages []string `yaml:"packages,omitempty"`
+	// Caches are the cache mounts (see caches) of the step, in addition to the spec's cache: section.
+	Caches []string `yaml:"caches,omitempty"`
+	// Network gives the step network access (e.g. fetch); other steps run without network.
+	Network bool `yaml:"network,omitempty"`
 }
 
 // PipelineDef is the structure of a pipeline YAML file.
@@ -51,6 +55,8 @@ type PipelineDef struct {
 	Needs  PipelineNeeds      `yaml:"needs,omitempty"`
 	Inputs map[string]InputDef `yaml:"inputs,omitempty"` // input name -> schema (default, required)
 	Runs   string             `yaml:"runs,omitempty"`
+	// Source makes the step a BuildKit source ("git") built from the inputs instead of running Runs.
+	Source string `yaml:"source,omitempty"`
 }
 
 var (
@@ -77,9 +83,15 @@ func getPipeline(name string) (*PipelineDef, error) {
 	if err := yaml.Unmarshal(data, &def); err != nil {
 		return nil, fmt.Errorf("pipeline %q: %w", name, err)
 	}
-	if def.Runs == "" {
+	if def.Source != "" && !validSource(def.Source) {
+		return nil, fmt.Errorf("pipeline %q: unknown source %q", name, def.Source)
+	}
+	if def.Runs == "" && def.Source == "" {
 		return nil, fmt.Errorf("pipeline %q: missing runs", name)
 	}
+	if err := validateCaches(def.Needs.Caches, fmt.Sprintf("pipeline %q: needs.caches", name)); err != nil {
+		return nil, err
+	}
 	if def.Inputs == nil {
 		def.Inputs = make(map[string]InputDef)
 	}
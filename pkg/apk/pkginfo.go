@@ -0,0 +1,179 @@
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// PKGInfo is the content of .PKGINFO in the control segment.
+type PKGInfo struct {
+	PkgName          string   `json:"pkgname"`
+	PkgVer           string   `json:"pkgver"` // version-rN
+	PkgDesc          string   `json:"pkgdesc"`
+	URL              string   `json:"url"`
+	BuildDate        int64    `json:"builddate"` // Unix seconds
+	Packager         string   `json:"packager,omitempty"`
+	Size             int64    `json:"size"` // installed size of the data segment in bytes
+	Arch             string   `json:"arch"`
+	Origin           string   `json:"origin,omitempty"`
+	Commit           string   `json:"commit,omitempty"`
+	Maintainer       string   `json:"maintainer,omitempty"`
+	ProviderPriority int      `json:"provider_priority,omitempty"`
+	ReplacesPriority int      `json:"replaces_priority,omitempty"`
+	License          string   `json:"license"`
+	Replaces         []string `json:"replaces,omitempty"`
+	Depends          []string `json:"depend,omitempty"`
+	Provides         []string `json:"provides,omitempty"`
+	InstallIf        []string `json:"install_if,omitempty"`
+	Triggers         []string `json:"triggers,omitempty"`
+	DataHash         string   `json:"datahash"` // hex SHA256 of the data segment
+}
+
+// newPKGInfo fills the spec-derived fields of .PKGINFO; size, datahash, arch and builddate
+// are set by AssembleAPK once the data segment is written.
+func newPKGInfo(s *spec.Spec) *PKGInfo {
+	pkgname := strings.ToLower(s.Name)
+	origin := s.Package.Origin
+	if origin == "" {
+		origin = pkgname
+	}
+	depends := append([]string(nil), s.Dependencies.Runtime...)
+	for _, c := range s.Dependencies.Conflicts {
+		depends = append(depends, "!"+strings.TrimPrefix(c, "!"))
+	}
+	return &PKGInfo{
+		PkgName:          pkgname,
+		PkgVer:           fmt.Sprintf("%s-r%d", s.Version, s.Epoch),
+		PkgDesc:          s.Description,
+		URL:              s.URL,
+		Packager:         s.Package.Packager,
+		Origin:           origin,
+		Commit:           packageCommit(s),
+		Maintainer:       s.Package.Maintainer,
+		ProviderPriority: s.Dependencies.ProviderPriority,
+		ReplacesPriority: s.Dependencies.ReplacesPriority,
+		License:          s.License,
+		Replaces:         s.Dependencies.Replaces,
+		Depends:          depends,
+		Provides:         s.Dependencies.Provides,
+		InstallIf:        s.Dependencies.InstallIf,
+		Triggers:         s.Package.Triggers,
+	}
+}
+
+// Bytes renders .PKGINFO (key = value, one per line) in the order abuild writes it.
+func (p *PKGInfo) Bytes() []byte {
+	var b strings.Builder
+	b.WriteString("# Generated by apkbuild\n")
+	kv := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, "%s = %s\n", k, v)
+		}
+	}
+	kv("pkgname", p.PkgName)
+	kv("pkgver", p.PkgVer)
+	// pkgdesc and url are always present, even when empty
+	fmt.Fprintf(&b, "pkgdesc = %s\n", p.PkgDesc)
+	fmt.Fprintf(&b, "url = %s\n", p.URL)
+	fmt.Fprintf(&b, "builddate = %d\n", p.BuildDate)
+	kv("packager", p.Packager)
+	fmt.Fprintf(&b, "size = %d\n", p.Size)
+	kv("arch", p.Arch)
+	kv("origin", p.Origin)
+	kv("commit", p.Commit)
+	kv("maintainer", p.Maintainer)
+	if p.ProviderPriority > 0 {
+		fmt.Fprintf(&b, "provider_priority = %d\n", p.ProviderPriority)
+	}
+	kv("license", p.License)
+	if p.ReplacesPriority > 0 {
+		fmt.Fprintf(&b, "replaces_priority = %d\n", p.ReplacesPriority)
+	}
+	for _, r := range p.Replaces {
+		kv("replaces", r)
+	}
+	for _, d := range p.Depends {
+		kv("depend", d)
+	}
+	for _, pr := range p.Provides {
+		kv("provides", pr)
+	}
+	if len(p.Triggers) > 0 {
+		kv("triggers", strings.Join(p.Triggers, " "))
+	}
+	if len(p.InstallIf) > 0 {
+		kv("install_if", strings.Join(p.InstallIf, " "))
+	}
+	kv("datahash", p.DataHash)
+	return []byte(b.String())
+}
+
+// ParsePKGInfo parses the content of .PKGINFO. Unknown keys are ignored.
+func ParsePKGInfo(data []byte) (*PKGInfo, error) {
+	p := &PKGInfo{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf(".PKGINFO line %d: expected \"key = value\"", i+1)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		var err error
+		switch k {
+		case "pkgname":
+			p.PkgName = v
+		case "pkgver":
+			p.PkgVer = v
+		case "pkgdesc":
+			p.PkgDesc = v
+		case "url":
+			p.URL = v
+		case "builddate":
+			p.BuildDate, err = strconv.ParseInt(v, 10, 64)
+		case "packager":
+			p.Packager = v
+		case "size":
+			p.Size, err = strconv.ParseInt(v, 10, 64)
+		case "arch":
+			p.Arch = v
+		case "origin":
+			p.Origin = v
+		case "commit":
+			p.Commit = v
+		case "maintainer":
+			p.Maintainer = v
+		case "provider_priority":
+			p.ProviderPriority, err = strconv.Atoi(v)
+		case "replaces_priority":
+			p.ReplacesPriority, err = strconv.Atoi(v)
+		case "license":
+			p.License = v
+		case "replaces":
+			p.Replaces = append(p.Replaces, strings.Fields(v)...)
+		case "depend":
+			p.Depends = append(p.Depends, strings.Fields(v)...)
+		case "provides":
+			p.Provides = append(p.Provides, strings.Fields(v)...)
+		case "install_if":
+			p.InstallIf = append(p.InstallIf, strings.Fields(v)...)
+		case "triggers":
+			p.Triggers = append(p.Triggers, strings.Fields(v)...)
+		case "datahash":
+			p.DataHash = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf(".PKGINFO line %d: %s: %w", i+1, k, err)
+		}
+	}
+	if p.PkgName == "" || p.PkgVer == "" {
+		return nil, errors.New(".PKGINFO: pkgname and pkgver are required")
+	}
+	return p, nil
+}
@@ -0,0 +1,269 @@
+package apk
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrADBFormat is returned when reading an apk-tools 3 (ADB) package, which this package writes
+// (FormatV3) but does not parse.
+var ErrADBFormat = errors.New("apk v3 (ADB) packages are not supported")
+
+// ReadPKGInfo reads the signature (if any) and control segments of the APK in r and returns the
+// parsed .PKGINFO and the SHA1 of the control segment, which APKINDEX records as the package
+// checksum (C:Q1...). The data segment is not read.
+func ReadPKGInfo(r io.Reader) (*PKGInfo, []byte, error) {
+	sr := newSegmentReader(r)
+	if sr.isADB() {
+		return nil, nil, ErrADBFormat
+	}
+	controlSum := sha1.New()
+	tr, err := sr.Next(controlSum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("first segment: %w", err)
+	}
+	h, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("first segment: %w", err)
+	}
+	if strings.HasPrefix(h.Name, ".SIGN.") {
+		// Signed package: the control segment is the second gzip member. Next drains the rest of
+		// the signature segment into the current hash first, so the control one is a new hash.
+		controlSum = sha1.New()
+		if tr, err = sr.Next(controlSum); err != nil {
+			return nil, nil, fmt.Errorf("control segment: %w", err)
+		}
+		if h, err = tr.Next(); err != nil {
+			return nil, nil, fmt.Errorf("control segment: %w", err)
+		}
+	}
+	if h.Name != ".PKGINFO" {
+		return nil, nil, fmt.Errorf("control segment: expected .PKGINFO first, got %q", h.Name)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("control segment: %w", err)
+	}
+	info, err := ParsePKGInfo(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sr.finish(); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, errors.New("control segment: truncated")
+		}
+		return nil, nil, fmt.Errorf("control segment: %w", err)
+	}
+	return info, controlSum.Sum(nil), nil
+}
+
+// Package is an APK as read by ReadAPK.
+type Package struct {
+	// Signatures are the entries of the signature segment (empty for unsigned packages).
+	Signatures []Signature `json:"signatures,omitempty"`
+	PKGInfo    *PKGInfo    `json:"pkginfo"`
+	// Scripts maps install script names in the control segment (".post-install", ...) to their content.
+	Scripts map[string]string `json:"scripts,omitempty"`
+	// ControlChecksum is the hex SHA1 of the control segment (APKINDEX C: field).
+	ControlChecksum string `json:"control_checksum"`
+	// DataHash is the hex SHA256 of the data segment as read, to compare with PKGInfo.DataHash.
+	DataHash string `json:"datahash"`
+	Files    []File `json:"files"`
+
+	controlDigests map[crypto.Hash][]byte // control segment digests for signature checks
+}
+
+// Signature is one .SIGN.<type>.<keyname> entry of the signature segment.
+type Signature struct {
+	Type      string `json:"type"`     // SignatureRSA or SignatureRSA256
+	KeyName   string `json:"key_name"` // e.g. "builder-5e69ca50.rsa.pub"
+	Signature []byte `json:"signature"`
+}
+
+// File is one entry of the data segment.
+type File struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // file, dir, symlink, hardlink, char, block or fifo
+	Mode     int64  `json:"mode"` // permission bits, including setuid/setgid/sticky
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Uname    string `json:"uname,omitempty"`
+	Gname    string `json:"gname,omitempty"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"` // Unix seconds
+	Linkname string `json:"linkname,omitempty"`
+	// Checksum is the hex SHA1 recorded in the APK-TOOLS.checksum.SHA1 PAX record (regular
+	// files: content, symlinks: target), empty when the entry carries none.
+	Checksum string `json:"checksum,omitempty"`
+
+	sum string // hex SHA1 of the content (or symlink target) as read
+}
+
+// VerifyDataHash reports whether the data segment matches the datahash declared in .PKGINFO.
+func (p *Package) VerifyDataHash() error {
+	if p.PKGInfo.DataHash == "" {
+		return fmt.Errorf("%w: .PKGINFO has no datahash", ErrDataHashMismatch)
+	}
+	if !strings.EqualFold(p.PKGInfo.DataHash, p.DataHash) {
+		return fmt.Errorf("%w: .PKGINFO has %s, data segment is %s", ErrDataHashMismatch, p.PKGInfo.DataHash, p.DataHash)
+	}
+	return nil
+}
+
+// ReadAPK reads a whole APK from r: the signature segment (if any), .PKGINFO and install scripts
+// from the control segment, and the file list of the data segment. File contents are read to
+// compute DataHash and per-file checksums (see Verify) but not kept.
+func ReadAPK(r io.Reader) (*Package, error) {
+	sr := newSegmentReader(r)
+	if sr.isADB() {
+		return nil, ErrADBFormat
+	}
+	p := &Package{}
+
+	controlSum, control256 := sha1.New(), sha256.New()
+	tr, err := sr.Next(io.MultiWriter(controlSum, control256))
+	if err != nil {
+		return nil, fmt.Errorf("first segment: %w", err)
+	}
+	h, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("first segment: %w", err)
+	}
+	if strings.HasPrefix(h.Name, ".SIGN.") {
+		for ; err == nil; h, err = tr.Next() {
+			sig, serr := readSignatureEntry(h, tr)
+			if serr != nil {
+				return nil, fmt.Errorf("signature segment: %w", serr)
+			}
+			p.Signatures = append(p.Signatures, sig)
+		}
+		if err != io.EOF {
+			return nil, fmt.Errorf("signature segment: %w", err)
+		}
+		controlSum.Reset()
+		control256.Reset()
+		if tr, err = sr.Next(io.MultiWriter(controlSum, control256)); err != nil {
+			return nil, fmt.Errorf("control segment: %w", err)
+		}
+		if h, err = tr.Next(); err != nil {
+			return nil, fmt.Errorf("control segment: %w", err)
+		}
+	}
+
+	if h.Name != ".PKGINFO" {
+		return nil, fmt.Errorf("control segment: expected .PKGINFO first, got %q", h.Name)
+	}
+	for ; err == nil; h, err = tr.Next() {
+		data, rerr := io.ReadAll(tr)
+		if rerr != nil {
+			return nil, fmt.Errorf("control segment: %s: %w", h.Name, rerr)
+		}
+		if h.Name == ".PKGINFO" {
+			if p.PKGInfo, err = ParsePKGInfo(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if p.Scripts == nil {
+			p.Scripts = make(map[string]string)
+		}
+		p.Scripts[h.Name] = string(data)
+	}
+	if err != io.EOF {
+		return nil, fmt.Errorf("control segment: %w", err)
+	}
+	p.ControlChecksum = hex.EncodeToString(controlSum.Sum(nil))
+	p.controlDigests = map[crypto.Hash][]byte{crypto.SHA1: controlSum.Sum(nil), crypto.SHA256: control256.Sum(nil)}
+
+	dataSum := sha256.New()
+	if tr, err = sr.Next(dataSum); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("data segment: missing")
+		}
+		return nil, fmt.Errorf("data segment: %w", err)
+	}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("data segment: %w", err)
+		}
+		f := fileFromHeader(h)
+		switch h.Typeflag {
+		case tar.TypeReg:
+			sum := sha1.New()
+			if _, err := io.Copy(sum, tr); err != nil {
+				return nil, fmt.Errorf("data segment: %s: %w", f.Name, err)
+			}
+			f.sum = hex.EncodeToString(sum.Sum(nil))
+		case tar.TypeSymlink:
+			sum := sha1.Sum([]byte(h.Linkname))
+			f.sum = hex.EncodeToString(sum[:])
+		}
+		p.Files = append(p.Files, f)
+	}
+	if err := sr.finish(); err != nil {
+		return nil, fmt.Errorf("data segment: %w", err)
+	}
+	// The data segment runs to the end of the file; anything after the gzip member is hashed too.
+	if _, err := io.Copy(dataSum, sr.src); err != nil {
+		return nil, fmt.Errorf("data segment: %w", err)
+	}
+	p.DataHash = hex.EncodeToString(dataSum.Sum(nil))
+	return p, nil
+}
+
+// readSignatureEntry parses a .SIGN.<type>.<keyname> entry.
+func readSignatureEntry(h *tar.Header, r io.Reader) (Signature, error) {
+	sigType, keyName, ok := strings.Cut(strings.TrimPrefix(h.Name, ".SIGN."), ".")
+	if !strings.HasPrefix(h.Name, ".SIGN.") || !ok {
+		return Signature{}, fmt.Errorf("malformed entry %q", h.Name)
+	}
+	sig, err := io.ReadAll(r)
+	if err != nil {
+		return Signature{}, err
+	}
+	return Signature{Type: sigType, KeyName: keyName, Signature: sig}, nil
+}
+
+// fileFromHeader converts a data segment tar header to a File.
+func fileFromHeader(h *tar.Header) File {
+	f := File{
+		Name:     strings.TrimSuffix(h.Name, "/"),
+		Mode:     h.Mode & 0o7777,
+		Uid:      h.Uid,
+		Gid:      h.Gid,
+		Uname:    h.Uname,
+		Gname:    h.Gname,
+		Size:     h.Size,
+		ModTime:  h.ModTime.Unix(),
+		Linkname: h.Linkname,
+		Checksum: h.PAXRecords[paxChecksumSHA1],
+	}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		f.Type = "dir"
+	case tar.TypeSymlink:
+		f.Type = "symlink"
+	case tar.TypeLink:
+		f.Type = "hardlink"
+	case tar.TypeChar:
+		f.Type = "char"
+	case tar.TypeBlock:
+		f.Type = "block"
+	case tar.TypeFifo:
+		f.Type = "fifo"
+	default:
+		f.Type = "file"
+	}
+	return f
+}
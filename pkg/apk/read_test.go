@@ -0,0 +1,119 @@
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// richTree covers the entry types Assemble packs: directories, regular files with special
+// modes, a symlink and a hardlink (reported through FileInfo.Sys, as refFS does).
+func richTree() fstest.MapFS {
+	tree := testTree()
+	tree["usr/bin/su-helper"] = &fstest.MapFile{Data: []byte("setuid\n"), Mode: fs.ModeSetuid | 0o755, ModTime: testEpoch}
+	tree["usr/bin/hi"] = &fstest.MapFile{Data: []byte("hello"), Mode: fs.ModeSymlink | 0o777, ModTime: testEpoch}
+	tree["usr/share/hello/b.txt"] = &fstest.MapFile{
+		Data:    []byte("a\n"),
+		Mode:    0o644,
+		ModTime: testEpoch,
+		Sys:     &tar.Header{Typeflag: tar.TypeLink, Linkname: "usr/share/hello/a.txt"},
+	}
+	tree["var"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: testEpoch}
+	tree["var/lib"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: testEpoch}
+	tree["var/lib/hello"] = &fstest.MapFile{Mode: fs.ModeDir | 0o700, ModTime: testEpoch}
+	return tree
+}
+
+func TestReadAPKPKGInfo(t *testing.T) {
+	s := testSpec()
+	s.URL = "https://example.com/hello"
+	s.Package.Maintainer = "Jane Doe <jane@example.com>"
+	s.Package.Origin = "hello-src"
+	s.Dependencies.Runtime = []string{"musl", "busybox>=1.36"}
+	s.Dependencies.Conflicts = []string{"hello-legacy"}
+	s.Dependencies.Provides = []string{"greeter=1.0"}
+	s.Scripts.PostInstall = spec.Script{Run: "echo installed"}
+
+	data := assembleBytes(t, richTree(), s, AssembleOptions{Arch: "x86_64"})
+	p, err := ReadAPK(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.VerifyDataHash(); err != nil {
+		t.Error(err)
+	}
+	want := &PKGInfo{
+		PkgName:    "hello",
+		PkgVer:     "1.0-r2",
+		PkgDesc:    "test package",
+		URL:        "https://example.com/hello",
+		BuildDate:  testEpoch.Unix(),
+		Size:       int64(len("#!/bin/sh\necho hello\n") + len("setuid\n") + len("a\n")),
+		Arch:       "x86_64",
+		Origin:     "hello-src",
+		Maintainer: "Jane Doe <jane@example.com>",
+		License:    "MIT",
+		Depends:    []string{"musl", "busybox>=1.36", "!hello-legacy"},
+		Provides:   []string{"greeter=1.0"},
+		DataHash:   p.DataHash,
+	}
+	if !reflect.DeepEqual(p.PKGInfo, want) {
+		t.Errorf("PKGInfo =\n%+v\nwant\n%+v", p.PKGInfo, want)
+	}
+	if got := p.Scripts[".post-install"]; got != "#!/bin/sh\necho installed\n" {
+		t.Errorf(".post-install = %q", got)
+	}
+	if len(p.Scripts) != 1 {
+		t.Errorf("scripts = %v, want only .post-install", p.Scripts)
+	}
+}
+
+func TestReadAPKFiles(t *testing.T) {
+	data := assembleBytes(t, richTree(), testSpec(), AssembleOptions{})
+	p, err := ReadAPK(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := testEpoch.Unix()
+	want := []File{
+		{Name: "usr", Type: "dir", Mode: 0o755},
+		{Name: "usr/bin", Type: "dir", Mode: 0o755},
+		{Name: "usr/bin/hello", Type: "file", Mode: 0o755, Size: 21, Checksum: sha1Hex("#!/bin/sh\necho hello\n")},
+		{Name: "usr/bin/hi", Type: "symlink", Mode: 0o777, Linkname: "hello", Checksum: sha1Hex("hello")},
+		{Name: "usr/bin/su-helper", Type: "file", Mode: 0o4755, Size: 7, Checksum: sha1Hex("setuid\n")},
+		{Name: "usr/share", Type: "dir", Mode: 0o755},
+		{Name: "usr/share/hello", Type: "dir", Mode: 0o755},
+		{Name: "usr/share/hello/a.txt", Type: "file", Mode: 0o644, Size: 2, Checksum: sha1Hex("a\n")},
+		{Name: "usr/share/hello/b.txt", Type: "hardlink", Mode: 0o644, Linkname: "usr/share/hello/a.txt"},
+		{Name: "var", Type: "dir", Mode: 0o755},
+		{Name: "var/lib", Type: "dir", Mode: 0o755},
+		{Name: "var/lib/hello", Type: "dir", Mode: 0o700},
+	}
+	if len(p.Files) != len(want) {
+		t.Fatalf("got %d files, want %d: %+v", len(p.Files), len(want), p.Files)
+	}
+	for i, w := range want {
+		w.Uname, w.Gname, w.ModTime = "root", "root", mtime
+		got := p.Files[i]
+		got.sum = ""
+		if got != w {
+			t.Errorf("file %d =\n%+v\nwant\n%+v", i, got, w)
+		}
+	}
+	// The recorded checksums match the content as read.
+	if _, _, err := Verify(bytes.NewReader(data), VerifyOptions{AllowUntrusted: true}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,89 @@
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// scriptFile is one install script as it appears in the control segment.
+type scriptFile struct {
+	name   string // e.g. ".pre-install"
+	field  string // spec key, e.g. "pre_install"
+	script *spec.Script
+}
+
+// scriptFiles returns the install scripts in sc in the order abuild packs them.
+func scriptFiles(sc *spec.Scripts) []scriptFile {
+	return []scriptFile{
+		{".pre-install", "pre_install", &sc.PreInstall},
+		{".post-install", "post_install", &sc.PostInstall},
+		{".pre-upgrade", "pre_upgrade", &sc.PreUpgrade},
+		{".post-upgrade", "post_upgrade", &sc.PostUpgrade},
+		{".pre-deinstall", "pre_deinstall", &sc.PreDeinstall},
+		{".post-deinstall", "post_deinstall", &sc.PostDeinstall},
+		{".trigger", "trigger", &sc.Trigger},
+	}
+}
+
+// validateScripts checks that each script sets exactly one of run/path and that a trigger
+// script and package.triggers are given together.
+func validateScripts(s *spec.Spec) error {
+	for _, f := range scriptFiles(&s.Scripts) {
+		if f.script.Run != "" && f.script.Path != "" {
+			return fmt.Errorf("scripts.%s: cannot set both 'run' and 'path'", f.field)
+		}
+	}
+	hasTrigger := !s.Scripts.Trigger.IsZero()
+	if hasTrigger && len(s.Package.Triggers) == 0 {
+		return errors.New("scripts.trigger requires package.triggers (directories that fire it)")
+	}
+	if !hasTrigger && len(s.Package.Triggers) > 0 {
+		return errors.New("package.triggers requires scripts.trigger")
+	}
+	return nil
+}
+
+// ResolveScripts replaces scripts given by path, in the spec and its subpackages, with their
+// content read with readFile (e.g. from the build context). Inline scripts are left untouched.
+func ResolveScripts(s *spec.Spec, readFile func(path string) ([]byte, error)) error {
+	if err := resolveScripts(&s.Scripts, readFile); err != nil {
+		return err
+	}
+	for i := range s.Subpackages {
+		if err := resolveScripts(&s.Subpackages[i].Scripts, readFile); err != nil {
+			return fmt.Errorf("subpackage %s: %w", s.Subpackages[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func resolveScripts(sc *spec.Scripts, readFile func(path string) ([]byte, error)) error {
+	for _, f := range scriptFiles(sc) {
+		if f.script.Path == "" {
+			continue
+		}
+		data, err := readFile(f.script.Path)
+		if err != nil {
+			return fmt.Errorf("scripts.%s: read %s: %w", f.field, f.script.Path, err)
+		}
+		f.script.Run = string(data)
+		f.script.Path = ""
+	}
+	return nil
+}
+
+// scriptContent returns the script body to pack, adding a /bin/sh shebang to inline scripts
+// without one (apk executes them directly).
+func scriptContent(sc *spec.Script) []byte {
+	if strings.HasPrefix(sc.Run, "#!") {
+		return []byte(sc.Run)
+	}
+	body := sc.Run
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	return []byte("#!/bin/sh\n" + body)
+}
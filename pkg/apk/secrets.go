@@ -0,0 +1,97 @@
+package apk
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const (
+	// secretsDir holds the secrets of a step that set neither env nor file (as in Dockerfile RUN --mount=type=secret).
+	secretsDir = "/run/secrets"
+	// sshAgentSocket is where the forwarded SSH agent is mounted in steps with ssh: true (exported as SSH_AUTH_SOCK).
+	sshAgentSocket = "/run/buildkit/ssh_agent.0"
+)
+
+// sshPackages are installed when a step forwards the SSH agent.
+var sshPackages = []string{"openssh-client"}
+
+var reEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateSecrets checks the spec's secrets: section and the secrets listed by every step.
+func validateSecrets(s *spec.Spec) error {
+	ids := make([]string, 0, len(s.Secrets))
+	for id := range s.Secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sec := s.Secrets[id]
+		if sec.Env != "" && !reEnvName.MatchString(sec.Env) {
+			return fmt.Errorf("secrets: %s: invalid env name %q", id, sec.Env)
+		}
+		if sec.File != "" && !path.IsAbs(sec.File) {
+			return fmt.Errorf("secrets: %s: file must be an absolute path, got %q", id, sec.File)
+		}
+	}
+	check := func(steps []spec.PipelineStep, prefix string) error {
+		for i, step := range steps {
+			for _, id := range step.Secrets {
+				if _, ok := s.Secrets[id]; !ok {
+					return fmt.Errorf("%s %d: secret %q is not declared in secrets:", prefix, i+1, id)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(s.Pipeline, "pipeline step"); err != nil {
+		return err
+	}
+	for _, sp := range s.Subpackages {
+		if err := check(sp.Pipeline, fmt.Sprintf("subpackage %s: pipeline step", sp.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usesSSH reports whether any step forwards the SSH agent.
+func usesSSH(s *spec.Spec) bool {
+	for _, step := range allSteps(s) {
+		if step.SSH {
+			return true
+		}
+	}
+	return false
+}
+
+// secretRunOptions returns the mounts of the step's secrets and SSH agent. Secrets are not part
+// of the cache key: a step is not rerun because a token changed.
+func secretRunOptions(s *spec.Spec, step spec.PipelineStep) []llb.RunOption {
+	var opts []llb.RunOption
+	for _, id := range step.Secrets {
+		sec := s.Secrets[id]
+		var secOpts []llb.SecretOption
+		if sec.Optional {
+			secOpts = append(secOpts, llb.SecretOptional)
+		}
+		if sec.Env != "" {
+			opts = append(opts, llb.AddSecretWithDest(id, nil, append(secOpts, llb.SecretAsEnvName(sec.Env))...))
+		}
+		if sec.File != "" || sec.Env == "" {
+			file := sec.File
+			if file == "" {
+				file = path.Join(secretsDir, id)
+			}
+			opts = append(opts, llb.AddSecret(file, append(secOpts, llb.SecretID(id))...))
+		}
+	}
+	if step.SSH {
+		opts = append(opts, llb.AddSSHSocket(llb.SSHSocketTarget(sshAgentSocket)), llb.AddEnv("SSH_AUTH_SOCK", sshAgentSocket))
+	}
+	return opts
+}
@@ -0,0 +1,104 @@
+package apk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func TestSecretRunOptions(t *testing.T) {
+	s := testSpec()
+	s.Secrets = map[string]spec.Secret{
+		"token":   {Env: "GITHUB_TOKEN"},
+		"netrc":   {File: "/root/.netrc", Optional: true},
+		"npmrc":   {},
+		"license": {Env: "LICENSE_KEY", File: "/etc/license.key"},
+	}
+	step := spec.PipelineStep{Run: "make", Secrets: []string{"token", "netrc", "npmrc", "license"}, SSH: true}
+	e := execOp(t, secretRunOptions(s, step)...)
+
+	type env struct {
+		id, name string
+		optional bool
+	}
+	var gotEnv []env
+	for _, se := range e.Secretenv {
+		gotEnv = append(gotEnv, env{se.ID, se.Name, se.Optional})
+	}
+	wantEnv := []env{{"token", "GITHUB_TOKEN", false}, {"license", "LICENSE_KEY", false}}
+	if len(gotEnv) != len(wantEnv) || gotEnv[0] != wantEnv[0] || gotEnv[1] != wantEnv[1] {
+		t.Errorf("secret env = %+v, want %+v", gotEnv, wantEnv)
+	}
+
+	type file struct {
+		id       string
+		optional bool
+	}
+	gotFiles := map[string]file{}
+	var ssh bool
+	for _, m := range e.Mounts {
+		switch m.MountType {
+		case pb.MountType_SECRET:
+			gotFiles[m.Dest] = file{m.SecretOpt.ID, m.SecretOpt.Optional}
+		case pb.MountType_SSH:
+			ssh = m.Dest == sshAgentSocket
+		}
+	}
+	wantFiles := map[string]file{
+		"/root/.netrc":       {"netrc", true},
+		"/run/secrets/npmrc": {"npmrc", false},
+		"/etc/license.key":   {"license", false},
+	}
+	if len(gotFiles) != len(wantFiles) {
+		t.Errorf("secret files = %+v, want %+v", gotFiles, wantFiles)
+	}
+	for dest, w := range wantFiles {
+		if g, ok := gotFiles[dest]; !ok || g != w {
+			t.Errorf("secret file %s = %+v, want %+v", dest, g, w)
+		}
+	}
+	if !ssh {
+		t.Errorf("no SSH agent mount at %s", sshAgentSocket)
+	}
+	if !strings.Contains(strings.Join(e.Meta.Env, "\n"), "SSH_AUTH_SOCK="+sshAgentSocket) {
+		t.Errorf("env %q does not set SSH_AUTH_SOCK", e.Meta.Env)
+	}
+
+	// A step without secrets gets none.
+	if e := execOp(t, secretRunOptions(s, spec.PipelineStep{Run: "make"})...); len(e.Secretenv) != 0 {
+		t.Errorf("secret env %v in a step without secrets", e.Secretenv)
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		secrets     map[string]spec.Secret
+		steps       []spec.PipelineStep
+		subpackages []spec.Subpackage
+		wantErr     string // "" when valid
+	}{
+		{"declared", map[string]spec.Secret{"token": {Env: "TOKEN"}}, []spec.PipelineStep{{Run: "make", Secrets: []string{"token"}}}, nil, ""},
+		{"declared but unused", map[string]spec.Secret{"token": {}}, []spec.PipelineStep{{Run: "make"}}, nil, ""},
+		{"undeclared", map[string]spec.Secret{"token": {}}, []spec.PipelineStep{{Run: "make"}, {Run: "make install", Secrets: []string{"netrc"}}}, nil, `pipeline step 2: secret "netrc" is not declared`},
+		{"undeclared in subpackage", nil, nil, []spec.Subpackage{{Name: "hello-dev", Pipeline: []spec.PipelineStep{{Run: "true", Secrets: []string{"token"}}}}}, `subpackage hello-dev: pipeline step 1: secret "token"`},
+		{"invalid env name", map[string]spec.Secret{"token": {Env: "GITHUB-TOKEN"}}, nil, nil, `secrets: token: invalid env name`},
+		{"relative file", map[string]spec.Secret{"netrc": {File: "root/.netrc"}}, nil, nil, `secrets: netrc: file must be an absolute path`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSpec()
+			s.Secrets = tt.secrets
+			s.Pipeline = tt.steps
+			s.Subpackages = tt.subpackages
+			err := validateSecrets(s)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
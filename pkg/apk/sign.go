@@ -0,0 +1,155 @@
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Signature types understood by apk-tools for v2 packages (same names abuild-sign uses).
+// RSA signs the SHA1 digest of the control segment, RSA256 the SHA256 digest.
+const (
+	SignatureRSA    = "RSA"
+	SignatureRSA256 = "RSA256"
+)
+
+// Signer produces RSA PKCS#1 v1.5 signatures over the digest of the control segment.
+// Implementations may keep the private key out of process (see frontend secretSigner).
+type Signer interface {
+	// KeyName is the public key file name as installed under /etc/apk/keys (e.g. "builder-5e69ca50.rsa.pub").
+	KeyName() string
+	// SignDigest signs digest, which was computed with hash h (crypto.SHA1 or crypto.SHA256).
+	SignDigest(h crypto.Hash, digest []byte) ([]byte, error)
+}
+
+// PublicKeySigner is a Signer that knows its public key. v3 (ADB) signatures identify the key
+// by a hash of the public key rather than by file name.
+type PublicKeySigner interface {
+	Signer
+	PublicKey() (*rsa.PublicKey, error)
+}
+
+// RSASigner signs with an in-memory RSA private key.
+type RSASigner struct {
+	Name string
+	Key  *rsa.PrivateKey
+}
+
+// NewRSASigner parses a PEM-encoded RSA private key (PKCS#1 or PKCS#8, as written by
+// abuild-keygen or openssl genrsa) and returns a signer for the given key name.
+func NewRSASigner(keyName string, pemData []byte) (*RSASigner, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("signing key: no PEM block found")
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("signing key: %w", err)
+		}
+		key = k
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("signing key: %w", err)
+		}
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("signing key: unsupported key type %T (RSA required)", k)
+		}
+		key = rk
+	default:
+		return nil, fmt.Errorf("signing key: unsupported PEM block %q", block.Type)
+	}
+	return &RSASigner{Name: NormalizeKeyName(keyName), Key: key}, nil
+}
+
+// KeyName implements Signer.
+func (s *RSASigner) KeyName() string { return s.Name }
+
+// PublicKey implements PublicKeySigner.
+func (s *RSASigner) PublicKey() (*rsa.PublicKey, error) { return &s.Key.PublicKey, nil }
+
+// SignDigest implements Signer.
+func (s *RSASigner) SignDigest(h crypto.Hash, digest []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(nil, s.Key, h, digest)
+}
+
+// NormalizeKeyName returns name in the "<name>.rsa.pub" form apk-tools looks up in /etc/apk/keys.
+// "builder", "builder.rsa" and "builder.rsa.pub" all map to "builder.rsa.pub".
+func NormalizeKeyName(name string) string {
+	name = strings.TrimSuffix(name, ".pub")
+	name = strings.TrimSuffix(name, ".rsa")
+	return name + ".rsa.pub"
+}
+
+// signatureHash returns the digest algorithm used for the given signature type.
+func signatureHash(sigType string) (crypto.Hash, func() hash.Hash, error) {
+	switch sigType {
+	case "", SignatureRSA:
+		return crypto.SHA1, sha1.New, nil
+	case SignatureRSA256:
+		return crypto.SHA256, sha256.New, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported signature type %q (use %s or %s)", sigType, SignatureRSA, SignatureRSA256)
+	}
+}
+
+// signatureFileName returns the entry name inside the signature segment, e.g. ".SIGN.RSA.builder.rsa.pub".
+func signatureFileName(sigType, keyName string) string {
+	if sigType == "" {
+		sigType = SignatureRSA
+	}
+	return ".SIGN." + sigType + "." + keyName
+}
+
+// buildSignatureTgz signs controlDigest and returns the signature segment (tar "cut", gzipped)
+// that is prepended to control + data, as abuild-sign does.
+func buildSignatureTgz(signer Signer, sigType string, controlDigest []byte) ([]byte, error) {
+	h, _, err := signatureHash(sigType)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.SignDigest(h, controlDigest)
+	if err != nil {
+		return nil, fmt.Errorf("sign control: %w", err)
+	}
+	var buf bytes.Buffer
+	_, err = writeTgz(&buf, tarCut, func(tw *tar.Writer) error {
+		h := &tar.Header{
+			Name:  signatureFileName(sigType, signer.KeyName()),
+			Mode:  0o644,
+			Size:  int64(len(sig)),
+			Uname: "root",
+			Gname: "root",
+		}
+		return writeTarFile(tw, h, bytes.NewReader(sig))
+	}, sha1.New())
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SignatureSegment returns the signature segment (gzipped .SIGN.<type>.<keyname> entry) for
+// segment, the gzip member it signs (an APK control segment or an APKINDEX tgz).
+func SignatureSegment(signer Signer, sigType string, segment []byte) ([]byte, error) {
+	_, newHash, err := signatureHash(sigType)
+	if err != nil {
+		return nil, err
+	}
+	d := newHash()
+	d.Write(segment)
+	return buildSignatureTgz(signer, sigType, d.Sum(nil))
+}
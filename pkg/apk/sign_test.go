@@ -0,0 +1,133 @@
+package apk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testSigner returns a signer for a 2048-bit key generated once per test binary.
+func testSigner(t testing.TB) *RSASigner {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testKey = k
+	})
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey)})
+	s, err := NewRSASigner("test", pemData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testSpec returns a minimal spec with automatic dependencies disabled.
+func testSpec() *spec.Spec {
+	return &spec.Spec{
+		Name:         "hello",
+		Version:      "1.0",
+		Epoch:        2,
+		Description:  "test package",
+		License:      "MIT",
+		Dependencies: spec.Dependencies{Auto: spec.AutoDeps{Disabled: true}},
+	}
+}
+
+// testEpoch is the SOURCE_DATE_EPOCH of the test packages.
+var testEpoch = time.Unix(1700000000, 0).UTC()
+
+// testTree is a small package tree.
+func testTree() fstest.MapFS {
+	return fstest.MapFS{
+		"usr":                   {Mode: 0o755 | fs.ModeDir, ModTime: testEpoch},
+		"usr/bin":               {Mode: 0o755 | fs.ModeDir, ModTime: testEpoch},
+		"usr/bin/hello":         {Data: []byte("#!/bin/sh\necho hello\n"), Mode: 0o755, ModTime: testEpoch},
+		"usr/share":             {Mode: 0o755 | fs.ModeDir, ModTime: testEpoch},
+		"usr/share/hello":       {Mode: 0o755 | fs.ModeDir, ModTime: testEpoch},
+		"usr/share/hello/a.txt": {Data: []byte("a\n"), Mode: 0o644, ModTime: testEpoch},
+	}
+}
+
+// assembleBytes assembles src with opts and returns the package.
+func assembleBytes(t testing.TB, src fstest.MapFS, s *spec.Spec, opts AssembleOptions) []byte {
+	t.Helper()
+	if opts.Arch == "" {
+		opts.Arch = ArchNoarch
+	}
+	if opts.SourceDateEpoch == nil {
+		opts.SourceDateEpoch = &testEpoch
+	}
+	var buf bytes.Buffer
+	if err := Assemble(&buf, src, s, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	signer := testSigner(t)
+	for _, sigType := range []string{SignatureRSA, SignatureRSA256} {
+		t.Run(sigType, func(t *testing.T) {
+			data := assembleBytes(t, testTree(), testSpec(), AssembleOptions{Signer: signer, SignatureType: sigType})
+			keys := map[string]*rsa.PublicKey{signer.KeyName(): &signer.Key.PublicKey}
+			name, err := VerifySignature(bytes.NewReader(data), keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "test.rsa.pub" {
+				t.Errorf("verified by %q, want test.rsa.pub", name)
+			}
+
+			p, err := ReadAPK(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Signatures) != 1 || p.Signatures[0].Type != sigType || p.Signatures[0].KeyName != "test.rsa.pub" {
+				t.Errorf("signatures = %+v, want one %s signature by test.rsa.pub", p.Signatures, sigType)
+			}
+		})
+	}
+}
+
+func TestSignatureWrongKey(t *testing.T) {
+	signer := testSigner(t)
+	data := assembleBytes(t, testTree(), testSpec(), AssembleOptions{Signer: signer})
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifySignature(bytes.NewReader(data), map[string]*rsa.PublicKey{signer.KeyName(): &other.PublicKey})
+	if err == nil {
+		t.Fatal("signature verified with the wrong key")
+	}
+	if errors.Is(err, ErrNotSigned) {
+		t.Errorf("got %v, want a signature mismatch", err)
+	}
+}
+
+func TestSignatureUnsigned(t *testing.T) {
+	data := assembleBytes(t, testTree(), testSpec(), AssembleOptions{})
+	signer := testSigner(t)
+	_, err := VerifySignature(bytes.NewReader(data), map[string]*rsa.PublicKey{signer.KeyName(): &signer.Key.PublicKey})
+	if !errors.Is(err, ErrNotSigned) {
+		t.Errorf("got %v, want ErrNotSigned", err)
+	}
+}
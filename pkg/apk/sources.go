@@ -0,0 +1,243 @@
+package apk
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const (
+	// gitCheckoutPipeline is the pipeline whose expected-commit is ${{git.commit}}.
+	gitCheckoutPipeline = "git-checkout"
+
+	sourceGit = "git"
+
+	// sourceMountDir is where a source is mounted while it is extracted to /src/<name>.
+	sourceMountDir = "/run/apkbuild/source"
+)
+
+// sourceStep is a pipeline step backed by a BuildKit source (PipelineDef.Source) instead of a
+// script: the source is resolved and cached by BuildKit, then copied to dest.
+type sourceStep struct {
+	state llb.State
+	dest  string
+}
+
+var (
+	reCommit = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+	reSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	reSHA512 = regexp.MustCompile(`^[0-9a-f]{128}$`)
+)
+
+// validSource reports whether kind is a PipelineDef.Source BuildAPK can translate.
+func validSource(kind string) bool {
+	return kind == sourceGit
+}
+
+// newSourceStep translates a source pipeline step with resolved inputs into its LLB source.
+// label identifies the step in errors.
+func newSourceStep(def *PipelineDef, inputs map[string]string, label string) (*sourceStep, error) {
+	in := func(name string) string { return strings.TrimSpace(inputs["${{inputs."+name+"}}"]) }
+	dest := path.Join("/src", in("destination"))
+	if dest != "/src" && !strings.HasPrefix(dest, "/src/") {
+		return nil, fmt.Errorf("%s: destination %q is outside /src", label, in("destination"))
+	}
+	switch def.Source {
+	case sourceGit:
+		st, err := gitSource(in, label)
+		if err != nil {
+			return nil, err
+		}
+		return &sourceStep{state: st, dest: dest}, nil
+	default:
+		return nil, fmt.Errorf("%s: unknown source %q", label, def.Source)
+	}
+}
+
+// gitSource returns the llb.Git state of a git-checkout step. BuildKit verifies expected-commit
+// (GitChecksum) against what the tag or branch resolves to; it is required, so that the
+// checkout is pinned and ${{git.commit}} is always known.
+func gitSource(in func(string) string, label string) (llb.State, error) {
+	repo, tag, branch, commit := in("repository"), in("tag"), in("branch"), in("expected-commit")
+	if tag != "" && branch != "" {
+		return llb.State{}, fmt.Errorf("%s (%s): set at most one of tag and branch", label, gitCheckoutPipeline)
+	}
+	if !reCommit.MatchString(commit) {
+		return llb.State{}, fmt.Errorf("%s (%s): expected-commit must be a full commit hash, got %q", label, gitCheckoutPipeline, commit)
+	}
+	ref := tag
+	if branch != "" {
+		ref = branch
+	}
+	if ref == "" {
+		ref = commit
+	}
+	if d := in("depth"); d != "" && d != "1" {
+		return llb.State{}, fmt.Errorf("%s (%s): depth %s is not supported (BuildKit fetches only the checked-out commit)", label, gitCheckoutPipeline, d)
+	}
+	opts := []llb.GitOption{llb.GitRef(ref), llb.GitChecksum(commit), llb.WithCustomNamef("git %s#%s", repo, ref)}
+	switch in("submodules") {
+	case "", "true":
+	case "false":
+		opts = append(opts, llb.GitSkipSubmodules())
+	default:
+		return llb.State{}, fmt.Errorf("%s (%s): submodules must be true or false", label, gitCheckoutPipeline)
+	}
+	return llb.Git(repo, "", opts...), nil
+}
+
+// GitCommit returns ${{git.commit}}: the expected-commit of the first git-checkout step of the
+// main pipeline, or "" when there is none.
+func GitCommit(s *spec.Spec) string {
+	for _, step := range s.Pipeline {
+		if step.Uses != gitCheckoutPipeline {
+			continue
+		}
+		if v, ok := step.With["expected-commit"]; ok {
+			return strings.TrimSpace(fmt.Sprint(v))
+		}
+	}
+	return ""
+}
+
+// packageCommit returns package.commit with ${{git.commit}} substituted, or ${{git.commit}}
+// when package.commit is not set.
+func packageCommit(s *spec.Spec) string {
+	if s.Package.Commit == "" {
+		return GitCommit(s)
+	}
+	return strings.ReplaceAll(s.Package.Commit, SubstitutionGitCommit, GitCommit(s))
+}
+
+// ValidateSources checks the spec's sources: each name is one path element under /src, and
+// http sources have a uri and exactly one checksum.
+func ValidateSources(s *spec.Spec) error {
+	for _, name := range sourceNames(s) {
+		src := s.Sources[name]
+		if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return fmt.Errorf("sources: invalid name %q (sources are placed at /src/<name>)", name)
+		}
+		if (src.Context != nil) == (src.HTTP != nil) {
+			return fmt.Errorf("sources: %s: set exactly one of context and http", name)
+		}
+		if src.HTTP == nil {
+			continue
+		}
+		h := src.HTTP
+		if h.URI == "" {
+			return fmt.Errorf("sources: %s: http.uri is required", name)
+		}
+		switch {
+		case h.SHA256 != "" && h.SHA512 != "":
+			return fmt.Errorf("sources: %s: set only one of http.sha256 and http.sha512", name)
+		case h.SHA256 != "":
+			if !reSHA256.MatchString(h.SHA256) {
+				return fmt.Errorf("sources: %s: http.sha256 must be 64 lowercase hex digits", name)
+			}
+		case h.SHA512 != "":
+			if !reSHA512.MatchString(h.SHA512) {
+				return fmt.Errorf("sources: %s: http.sha512 must be 128 lowercase hex digits", name)
+			}
+		default:
+			return fmt.Errorf("sources: %s: http.sha256 or http.sha512 is required", name)
+		}
+		if f := httpFilename(h); f == "" {
+			return fmt.Errorf("sources: %s: http.uri has no file name, set http.filename", name)
+		} else if f == "." || f == ".." || strings.Contains(f, "/") {
+			return fmt.Errorf("sources: %s: invalid filename %q", name, f)
+		}
+		if h.StripComponents < 0 {
+			return fmt.Errorf("sources: %s: http.strip_components must not be negative", name)
+		}
+		if h.StripComponents > 0 && !h.Extract {
+			return fmt.Errorf("sources: %s: http.strip_components requires http.extract", name)
+		}
+	}
+	return nil
+}
+
+// sourceNames returns the names of the spec's sources, sorted.
+func sourceNames(s *spec.Spec) []string {
+	names := make([]string, 0, len(s.Sources))
+	for name := range s.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// httpFilename returns the file name of an http source: filename, or the last element of the URI
+// path ("" when the path has none, e.g. https://example.com/).
+func httpFilename(h *spec.HTTPSource) string {
+	if h.Filename != "" {
+		return h.Filename
+	}
+	u, err := url.Parse(h.URI)
+	if err != nil || strings.Trim(u.Path, "/") == "" {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+// HTTPSourceState returns the verified download of the http source name, a state holding the
+// file at /<filename>. BuildKit checks sha256 itself (mismatches fail the download); it only
+// computes sha256, so a sha512 is checked with sha512sum in an exec without network.
+func HTTPSourceState(name string, h *spec.HTTPSource) llb.State {
+	filename := httpFilename(h)
+	opts := []llb.HTTPOption{llb.Filename(filename), llb.WithCustomNamef("download source %s (%s)", name, h.URI)}
+	if h.SHA256 != "" {
+		return llb.HTTP(h.URI, append(opts, llb.Checksum(digest.NewDigestFromEncoded(digest.SHA256, h.SHA256)))...)
+	}
+	dl := llb.HTTP(h.URI, opts...)
+	return llb.Image(alpineImage).Run(
+		llb.Args([]string{"sh", "-c", `echo "$SUM  /out/$FILE" | sha512sum -c -`}),
+		llb.AddEnv("SUM", h.SHA512),
+		llb.AddEnv("FILE", filename),
+		llb.Network(llb.NetModeNone),
+		llb.WithCustomNamef("verify source %s sha512", name),
+	).AddMount("/out", dl)
+}
+
+// placeSources puts each of sources (by spec source name) at /src/<name> in root: extracted
+// with tar for http sources with extract, copied otherwise (keeping the include/exclude
+// patterns of context sources).
+func placeSources(root llb.State, s *spec.Spec, sources map[string]llb.State, opts []llb.ConstraintsOpt) llb.State {
+	for _, name := range sourceNames(s) {
+		st, ok := sources[name]
+		if !ok {
+			continue
+		}
+		dest := path.Join("/src", name)
+		if h := s.Sources[name].HTTP; h != nil && h.Extract {
+			runOpts := []llb.RunOption{
+				llb.Args([]string{"sh", "-c", `mkdir -p "$DEST" && tar -x -f "$SRC" -C "$DEST" --strip-components="$STRIP" --no-same-owner`}),
+				llb.AddEnv("SRC", path.Join(sourceMountDir, httpFilename(h))),
+				llb.AddEnv("DEST", dest),
+				llb.AddEnv("STRIP", strconv.Itoa(h.StripComponents)),
+				llb.AddMount(sourceMountDir, st, llb.Readonly),
+				llb.Network(llb.NetModeNone),
+				llb.WithCustomNamef("extract source %s", name),
+			}
+			for _, o := range opts {
+				runOpts = append(runOpts, o)
+			}
+			root = root.Run(runOpts...).Root()
+			continue
+		}
+		info := &llb.CopyInfo{CopyDirContentsOnly: true, CreateDestPath: true}
+		if c := s.Sources[name].Context; c != nil {
+			info.IncludePatterns, info.ExcludePatterns = c.Include, c.Exclude
+		}
+		copyOpts := append([]llb.ConstraintsOpt{llb.WithCustomNamef("copy source %s", name)}, opts...)
+		root = root.File(llb.Copy(st, "/", dest, info), copyOpts...)
+	}
+	return root
+}
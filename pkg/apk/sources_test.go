@@ -0,0 +1,184 @@
+package apk
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+const testCommit = "3f2a9c0d7b1e4f5a6b7c8d9e0f1a2b3c4d5e6f70"
+
+func TestGitSourceStep(t *testing.T) {
+	def, err := getPipeline(gitCheckoutPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		with map[string]string
+		dest string // "" when the step is rejected
+	}{
+		{"tag", map[string]string{"tag": "v1.0.0", "expected-commit": testCommit}, "/src"},
+		{"subdir", map[string]string{"tag": "v1.0.0", "expected-commit": testCommit, "destination": "hello"}, "/src/hello"},
+		{"absolute", map[string]string{"tag": "v1.0.0", "expected-commit": testCommit, "destination": "/hello"}, "/src/hello"},
+		{"commit only", map[string]string{"expected-commit": testCommit}, "/src"},
+		{"no commit", map[string]string{"tag": "v1.0.0"}, ""},
+		{"short commit", map[string]string{"tag": "v1.0.0", "expected-commit": "3f2a9c0"}, ""},
+		{"escape", map[string]string{"tag": "v1.0.0", "expected-commit": testCommit, "destination": "../etc"}, ""},
+		{"escape nested", map[string]string{"tag": "v1.0.0", "expected-commit": testCommit, "destination": "a/../../etc"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs := map[string]string{"${{inputs.repository}}": "https://example.com/hello.git"}
+			for k, v := range tt.with {
+				inputs["${{inputs."+k+"}}"] = v
+			}
+			src, err := newSourceStep(def, inputs, "pipeline[0]")
+			switch {
+			case tt.dest == "" && err == nil:
+				t.Fatalf("step accepted, dest %s", src.dest)
+			case tt.dest != "" && err != nil:
+				t.Fatal(err)
+			case err == nil && src.dest != tt.dest:
+				t.Errorf("dest = %s, want %s", src.dest, tt.dest)
+			}
+		})
+	}
+}
+
+func TestPackageCommit(t *testing.T) {
+	s := testSpec()
+	s.Pipeline = []spec.PipelineStep{{Uses: gitCheckoutPipeline, With: map[string]interface{}{"tag": "v1.0.0", "expected-commit": testCommit}}}
+	if got := packageCommit(s); got != testCommit {
+		t.Errorf("default commit = %q, want %q", got, testCommit)
+	}
+	s.Package.Commit = "aports-" + SubstitutionGitCommit
+	if got := packageCommit(s); got != "aports-"+testCommit {
+		t.Errorf("commit = %q, want %q", got, "aports-"+testCommit)
+	}
+}
+
+var (
+	testSHA256 = strings.Repeat("ab", 32)
+	testSHA512 = strings.Repeat("cd", 64)
+)
+
+func TestValidateSources(t *testing.T) {
+	const uri = "https://example.com/hello-1.0.tar.gz"
+	for _, tt := range []struct {
+		name    string
+		sources map[string]spec.Source
+		wantErr string // "" when valid
+	}{
+		{"context", map[string]spec.Source{"vendor": {Context: &spec.SourceContext{}}}, ""},
+		{"sha256", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256}}}, ""},
+		{"sha512", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA512: testSHA512}}}, ""},
+		{"extract", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256, Extract: true, StripComponents: 1}}}, ""},
+		{"no checksum", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri}}}, "http.sha256 or http.sha512 is required"},
+		{"both checksums", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256, SHA512: testSHA512}}}, "set only one of"},
+		{"short sha256", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256[:63]}}}, "64 lowercase hex digits"},
+		{"uppercase sha256", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: strings.ToUpper(testSHA256)}}}, "64 lowercase hex digits"},
+		{"sha256 as sha512", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA512: testSHA256}}}, "128 lowercase hex digits"},
+		{"no uri", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{SHA256: testSHA256}}}, "http.uri is required"},
+		{"strip without extract", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256, StripComponents: 1}}}, "requires http.extract"},
+		{"negative strip", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256, Extract: true, StripComponents: -1}}}, "must not be negative"},
+		{"filename with slash", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256, Filename: "a/b.tar.gz"}}}, "invalid filename"},
+		{"uri without file name", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: "https://example.com/", SHA256: testSHA256}}}, "http.uri has no file name"},
+		{"filename for uri without file name", map[string]spec.Source{"hello": {HTTP: &spec.HTTPSource{URI: "https://example.com/", SHA256: testSHA256, Filename: "hello.tar.gz"}}}, ""},
+		{"neither context nor http", map[string]spec.Source{"hello": {}}, "set exactly one of context and http"},
+		{"context and http", map[string]spec.Source{"hello": {Context: &spec.SourceContext{}, HTTP: &spec.HTTPSource{URI: uri, SHA256: testSHA256}}}, "set exactly one of context and http"},
+		{"nested name", map[string]spec.Source{"a/b": {Context: &spec.SourceContext{}}}, "invalid name"},
+		{"dot name", map[string]spec.Source{"..": {Context: &spec.SourceContext{}}}, "invalid name"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSpec()
+			s.Sources = tt.sources
+			err := ValidateSources(s)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPFilename(t *testing.T) {
+	for _, tt := range []struct {
+		uri, filename, want string
+	}{
+		{"https://example.com/hello-1.0.tar.gz", "", "hello-1.0.tar.gz"},
+		{"https://example.com/download/hello-1.0.tar.gz?raw=1#top", "", "hello-1.0.tar.gz"},
+		{"https://example.com/archive/v1.0.tar.gz", "hello-1.0.tar.gz", "hello-1.0.tar.gz"},
+		{"https://example.com/", "", ""},
+		{"https://example.com", "", ""},
+	} {
+		if got := httpFilename(&spec.HTTPSource{URI: tt.uri, Filename: tt.filename}); got != tt.want {
+			t.Errorf("httpFilename(%q, %q) = %q, want %q", tt.uri, tt.filename, got, tt.want)
+		}
+	}
+}
+
+// marshalOps returns the ops of st.
+func marshalOps(t *testing.T, st llb.State) []*pb.Op {
+	t.Helper()
+	def, err := st.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []*pb.Op
+	for _, dt := range def.Def {
+		op := &pb.Op{}
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestHTTPSourceState(t *testing.T) {
+	const uri = "https://example.com/download?file=hello"
+	// sha256 is checked by the BuildKit download itself.
+	ops := marshalOps(t, HTTPSourceState("hello", &spec.HTTPSource{URI: uri, SHA256: testSHA256, Filename: "hello.tar.gz"}))
+	var src *pb.SourceOp
+	for _, op := range ops {
+		if op.GetExec() != nil {
+			t.Error("sha256 source verified in an exec")
+		}
+		if s := op.GetSource(); s != nil {
+			src = s
+		}
+	}
+	if src == nil || src.Identifier != uri || src.Attrs[pb.AttrHTTPChecksum] != "sha256:"+testSHA256 || src.Attrs[pb.AttrHTTPFilename] != "hello.tar.gz" {
+		t.Errorf("source op = %v, want %s with checksum and filename", src, uri)
+	}
+
+	// sha512 is checked with sha512sum, without network.
+	ops = marshalOps(t, HTTPSourceState("hello", &spec.HTTPSource{URI: uri, SHA512: testSHA512, Filename: "hello.tar.gz"}))
+	var exec *pb.ExecOp
+	for _, op := range ops {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+		if s := op.GetSource(); s != nil && s.Identifier == uri && s.Attrs[pb.AttrHTTPChecksum] != "" {
+			t.Errorf("sha512 source has a BuildKit checksum %s", s.Attrs[pb.AttrHTTPChecksum])
+		}
+	}
+	if exec == nil {
+		t.Fatal("sha512 source is not verified")
+	}
+	if exec.Network != pb.NetMode_NONE {
+		t.Errorf("sha512 check network = %v, want none", exec.Network)
+	}
+	for _, kv := range []string{"SUM=" + testSHA512, "FILE=hello.tar.gz"} {
+		if !slices.Contains(exec.Meta.Env, kv) {
+			t.Errorf("sha512 check env %q does not have %s", exec.Meta.Env, kv)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package apk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// spool is an append-only temporary file. The package formats put the metadata, which holds the
+// hashes of the files, before the files, so assembly writes the files into a spool as it reads
+// them from the source (each exactly once) and copies the package out of it at the end: the
+// data segment for v2 (see writeDataTgz), the file contents for v3 (see writeV3).
+type spool struct {
+	f    *os.File
+	size int64
+}
+
+func newSpool() (*spool, error) {
+	f, err := os.CreateTemp("", "apkbuild-spool-")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f}, nil
+}
+
+// Write appends p.
+func (s *spool) Write(p []byte) (int, error) {
+	n, err := s.f.WriteAt(p, s.size)
+	s.size += int64(n)
+	return n, err
+}
+
+// WriteAt overwrites written content at off.
+func (s *spool) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > s.size {
+		return 0, errors.New("spool: write past the end")
+	}
+	return s.f.WriteAt(p, off)
+}
+
+// Section returns a reader for n bytes at off.
+func (s *spool) Section(off, n int64) *io.SectionReader { return io.NewSectionReader(s.f, off, n) }
+
+// Close removes the file.
+func (s *spool) Close() error {
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// add copies the file name of src into s, also writing it to h, and returns a reader for the
+// copy. buf is the copy buffer.
+func (s *spool) add(src fs.FS, name string, size int64, h io.Writer, buf []byte) (*io.SectionReader, error) {
+	off := s.size
+	if err := copyFile(io.MultiWriter(s, h), src, name, size, buf); err != nil {
+		return nil, err
+	}
+	return s.Section(off, size), nil
+}
+
+// paxSHA1Offset returns the offset of the checksum value in the PAX header that writeDataHeader
+// wrote at off with sha1Placeholder. tar.Writer sorts the records by key and the uppercase
+// APK-TOOLS key sorts first, so the record starts the PAX data, right after its header block.
+func (s *spool) paxSHA1Offset(off int64) (int64, error) {
+	record := fmt.Sprintf(" %s=%s\n", paxChecksumSHA1, sha1Placeholder)
+	record = fmt.Sprintf("%d%s", len(record)+2, record) // the length has two digits
+	got := make([]byte, len(record))
+	if _, err := s.f.ReadAt(got, off+512); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(got, []byte(record)) {
+		return 0, fmt.Errorf("no %s record at the start of the PAX header", paxChecksumSHA1)
+	}
+	return off + 512 + int64(len(record)-len(sha1Placeholder)-1), nil
+}
+
+// copyFile copies the file name of src to w through buf. A file whose size is not size (it
+// changed since it was listed) is an error.
+func copyFile(w io.Writer, src fs.FS, name string, size int64, buf []byte) error {
+	f, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.CopyBuffer(w, f, buf)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: size changed while reading (%d of %d bytes)", name, n, size)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package apk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+// validateSubpackages checks subpackage names and the fields they carry over to their own spec.
+func validateSubpackages(s *spec.Spec) error {
+	seen := map[string]struct{}{strings.ToLower(s.Name): {}}
+	for i, sp := range s.Subpackages {
+		if sp.Name == "" {
+			return fmt.Errorf("subpackages[%d]: name is required", i)
+		}
+		if !rePackageName.MatchString(sp.Name) {
+			return fmt.Errorf("subpackage %s: invalid name", sp.Name)
+		}
+		if _, ok := seen[strings.ToLower(sp.Name)]; ok {
+			return fmt.Errorf("subpackage %s: name is used more than once", sp.Name)
+		}
+		seen[strings.ToLower(sp.Name)] = struct{}{}
+		if sp.Arch != "" && sp.Arch != ArchNoarch {
+			return fmt.Errorf("subpackage %s: arch must be empty or %q", sp.Name, ArchNoarch)
+		}
+		sub := SubpackageSpec(s, sp)
+		if err := validateDependencies(sub); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+		if err := validateScripts(sub); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+	}
+	return nil
+}
+
+// SubpackageSpec returns the spec a subpackage is assembled with: the main package's version,
+// url and license with the subpackage's name, description, arch, dependencies and scripts.
+// origin is the main package, as abuild records it for split packages.
+func SubpackageSpec(s *spec.Spec, sp spec.Subpackage) *spec.Spec {
+	sub := *s
+	sub.Name = sp.Name
+	if sp.Description != "" {
+		sub.Description = sp.Description
+	}
+	sub.Arch = sp.Arch
+	if s.Arch == ArchNoarch {
+		sub.Arch = ArchNoarch
+	}
+	sub.Dependencies = sp.Dependencies
+	sub.Scripts = sp.Scripts
+	sub.Package.Triggers = sp.Triggers
+	// ${{git.commit}} comes from the main pipeline, which the subpackage spec does not carry.
+	sub.Package.Commit = packageCommit(s)
+	if sub.Package.Origin == "" {
+		sub.Package.Origin = strings.ToLower(s.Name)
+	}
+	sub.Pipeline = sp.Pipeline
+	sub.Subpackages = nil
+	return &sub
+}
@@ -0,0 +1,113 @@
+package apk
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+func TestValidateSubpackages(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		subs    []spec.Subpackage
+		wantErr string // "" when valid
+	}{
+		{"valid", []spec.Subpackage{{Name: "hello-doc", Arch: ArchNoarch}, {Name: "hello-dev"}}, ""},
+		{"missing name", []spec.Subpackage{{Name: "hello-doc"}, {}}, "subpackages[1]: name is required"},
+		{"invalid name", []spec.Subpackage{{Name: "hello doc"}}, "invalid name"},
+		{"duplicate name", []spec.Subpackage{{Name: "hello-doc"}, {Name: "hello-doc"}}, "used more than once"},
+		{"duplicate name in another case", []spec.Subpackage{{Name: "hello-doc"}, {Name: "Hello-Doc"}}, "used more than once"},
+		{"main package name", []spec.Subpackage{{Name: "hello"}}, "used more than once"},
+		{"arch", []spec.Subpackage{{Name: "hello-dev", Arch: "x86_64"}}, "arch must be empty or"},
+		{"dependencies", []spec.Subpackage{{Name: "hello-dev", Dependencies: spec.Dependencies{Runtime: []string{"hello >= 1"}}}}, "subpackage hello-dev: dependencies.runtime"},
+		{"scripts", []spec.Subpackage{{Name: "hello-dev", Scripts: spec.Scripts{PostInstall: spec.Script{Run: "true", Path: "post-install"}}}}, "subpackage hello-dev:"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSpec()
+			s.Subpackages = tt.subs
+			err := validateSubpackages(s)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubpackageSpec(t *testing.T) {
+	s := testSpec()
+	s.Name = "Hello"
+	s.URL = "https://example.com"
+	s.Package.Maintainer = "Jane <jane@example.com>"
+	s.Dependencies.Runtime = []string{"musl"}
+	s.Scripts.PostInstall.Run = "echo main"
+	s.Pipeline = []spec.PipelineStep{{Run: "make install"}}
+	sp := spec.Subpackage{
+		Name:         "hello-doc",
+		Arch:         ArchNoarch,
+		Dependencies: spec.Dependencies{Runtime: []string{"man-pages"}},
+		Triggers:     []string{"/usr/share/man"},
+		Pipeline:     []spec.PipelineStep{{Uses: "split/manpages"}},
+	}
+	s.Subpackages = []spec.Subpackage{sp}
+
+	sub := SubpackageSpec(s, sp)
+	if sub.Name != "hello-doc" || sub.Version != "1.0" || sub.Epoch != 2 || sub.License != "MIT" || sub.URL != "https://example.com" {
+		t.Errorf("name, version, epoch, license, url = %s %s %d %s %s", sub.Name, sub.Version, sub.Epoch, sub.License, sub.URL)
+	}
+	if sub.Description != "test package" {
+		t.Errorf("description = %q, want the main one", sub.Description)
+	}
+	if sub.Package.Origin != "hello" || sub.Package.Maintainer != "Jane <jane@example.com>" {
+		t.Errorf("origin, maintainer = %q, %q", sub.Package.Origin, sub.Package.Maintainer)
+	}
+	if sub.Arch != ArchNoarch {
+		t.Errorf("arch = %q, want noarch", sub.Arch)
+	}
+	if !slices.Equal(sub.Dependencies.Runtime, []string{"man-pages"}) || !sub.Scripts.PostInstall.IsZero() {
+		t.Errorf("dependencies %v and scripts %+v are the main package's", sub.Dependencies.Runtime, sub.Scripts)
+	}
+	if !slices.Equal(sub.Package.Triggers, sp.Triggers) || len(sub.Pipeline) != 1 || sub.Pipeline[0].Uses != "split/manpages" || sub.Subpackages != nil {
+		t.Errorf("triggers %v, pipeline %+v, subpackages %+v", sub.Package.Triggers, sub.Pipeline, sub.Subpackages)
+	}
+	// The main spec is unchanged.
+	if s.Name != "Hello" || len(s.Subpackages) != 1 || s.Pipeline[0].Run != "make install" || s.Scripts.PostInstall.Run != "echo main" {
+		t.Errorf("main spec modified: %+v", s)
+	}
+
+	sp.Description = "hello documentation"
+	s.Package.Origin = "hello-src"
+	sub = SubpackageSpec(s, sp)
+	if sub.Description != "hello documentation" || sub.Package.Origin != "hello-src" {
+		t.Errorf("description, origin = %q, %q", sub.Description, sub.Package.Origin)
+	}
+}
+
+func TestSubpackageSpecArch(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		main, sub string
+		wantArch  string
+		wantPkg   string // PackageArch on aarch64
+	}{
+		{"platform arch", "", "", "", "aarch64"},
+		{"noarch subpackage", "", ArchNoarch, ArchNoarch, ArchNoarch},
+		{"noarch main package", ArchNoarch, "", ArchNoarch, ArchNoarch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSpec()
+			s.Arch = tt.main
+			sub := SubpackageSpec(s, spec.Subpackage{Name: "hello-dev", Arch: tt.sub})
+			if sub.Arch != tt.wantArch {
+				t.Errorf("arch = %q, want %q", sub.Arch, tt.wantArch)
+			}
+			if got := PackageArch(sub, "aarch64"); got != tt.wantPkg {
+				t.Errorf("package arch = %q, want %q", got, tt.wantPkg)
+			}
+		})
+	}
+}
@@ -20,7 +20,14 @@ const (
 	SubstitutionTargetsOutdir      = "${{targets.outdir}}"
 	SubstitutionTargetsDestdir     = "${{targets.destdir}}"
 	SubstitutionTargetsContextdir  = "${{targets.contextdir}}"
+	SubstitutionTargetsSubpkgdir   = "${{targets.subpkgdir}}"
 	SubstitutionContextName        = "${{context.name}}"
+	SubstitutionBuildArch          = "${{build.arch}}"
+	SubstitutionBuildTripletGNU    = "${{build.triplet.gnu}}"
+	SubstitutionTargetArch         = "${{target.arch}}"
+	SubstitutionHostTripletGNU     = "${{host.triplet.gnu}}"
+	SubstitutionHostSysroot        = "${{host.sysroot}}"
+	SubstitutionGitCommit          = "${{git.commit}}"
 )
 
 // Install destination and source directory used during the build.
@@ -29,8 +36,15 @@ const (
 	TargetsDestdir    = "/workspace/build-out"
 	TargetsContextdir = "/workspace/build-out"
 	PackageSrcdir     = "/workspace/build-src"
+	// SubpackagesOutdir holds one directory per subpackage (see SubpackageDir), outside the main destdir.
+	SubpackagesOutdir = "/workspace/subpkg-out"
 )
 
+// SubpackageDir returns the install destination of the named subpackage (${{targets.subpkgdir}}).
+func SubpackageDir(name string) string {
+	return SubpackagesOutdir + "/" + name
+}
+
 // SubstitutionMap holds variable name -> value for pipeline substitution (melange-style).
 // See: https://github.com/chainguard-dev/melange/blob/main/pkg/build/pipeline.go
 type SubstitutionMap struct {
@@ -38,8 +52,9 @@ type SubstitutionMap struct {
 }
 
 // NewSubstitutionMap returns a SubstitutionMap for the given spec (melange-style behavior).
-// Used to substitute ${{package.xxx}}, ${{targets.xxx}}, ${{context.name}} in pipeline runs.
-func NewSubstitutionMap(s *spec.Spec) (*SubstitutionMap, error) {
+// Used to substitute ${{package.xxx}}, ${{targets.xxx}}, ${{context.name}} in pipeline runs, and
+// the ${{build.xxx}}, ${{target.xxx}} and ${{host.xxx}} architecture variables of arch.
+func NewSubstitutionMap(s *spec.Spec, arch BuildArch) (*SubstitutionMap, error) {
 	fullVersion := s.Version
 	if s.Epoch > 0 {
 		fullVersion = fmt.Sprintf("%s-r%d", s.Version, s.Epoch)
@@ -59,10 +74,26 @@ func NewSubstitutionMap(s *spec.Spec) (*SubstitutionMap, error) {
 		SubstitutionTargetsDestdir:     TargetsDestdir,
 		SubstitutionTargetsContextdir:  TargetsContextdir,
 		SubstitutionContextName:        s.Name,
+		SubstitutionGitCommit:          GitCommit(s),
+	}
+	archSubs, err := archSubstitutions(arch)
+	if err != nil {
+		return nil, err
 	}
+	maps.Copy(nw, archSubs)
 	return &SubstitutionMap{Substitutions: nw}, nil
 }
 
+// ForSubpackage returns a copy of the map for a subpackage pipeline: ${{targets.subpkgdir}} and
+// ${{targets.contextdir}} point at the subpackage's directory, ${{targets.destdir}} stays the
+// main package's destdir so split pipelines can move files out of it.
+func (sm *SubstitutionMap) ForSubpackage(name string) *SubstitutionMap {
+	nw := maps.Clone(sm.Substitutions)
+	nw[SubstitutionTargetsSubpkgdir] = SubpackageDir(name)
+	nw[SubstitutionTargetsContextdir] = SubpackageDir(name)
+	return &SubstitutionMap{Substitutions: nw}
+}
+
 // MutateWith merges "with" into a clone of the substitution map (as ${{inputs.<key>}}),
 // then performs recursive substitution on all values so they can reference each other.
 // Returns the resulting map. Mirrors melange's SubstitutionMap.MutateWith.
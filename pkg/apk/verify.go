@@ -0,0 +1,280 @@
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// segmentReader splits an APK stream into its concatenated gzip members.
+// It implements flate.Reader so gzip.Reader consumes exactly one member and no more,
+// and copies every consumed (compressed) byte to raw when set.
+type segmentReader struct {
+	src *bufio.Reader
+	raw io.Writer
+	gz  *gzip.Reader
+}
+
+func newSegmentReader(r io.Reader) *segmentReader {
+	return &segmentReader{src: bufio.NewReader(r)}
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	n, err := s.src.Read(p)
+	if n > 0 && s.raw != nil {
+		s.raw.Write(p[:n])
+	}
+	return n, err
+}
+
+func (s *segmentReader) ReadByte() (byte, error) {
+	b, err := s.src.ReadByte()
+	if err == nil && s.raw != nil {
+		s.raw.Write([]byte{b})
+	}
+	return b, err
+}
+
+// isADB reports whether the stream is an ADB (v3) file ("ADB." or compressed "ADBd"/"ADBc").
+func (s *segmentReader) isADB() bool {
+	b, _ := s.src.Peek(3)
+	return string(b) == "ADB"
+}
+
+// Next finishes the current member and starts the next one. The compressed bytes of the new
+// member are copied to raw (may be nil). Returns io.EOF when there are no more members.
+func (s *segmentReader) Next(raw io.Writer) (*tar.Reader, error) {
+	if s.gz != nil {
+		if err := s.finish(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.src.Peek(1); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	s.raw = raw
+	if s.gz == nil {
+		gz, err := gzip.NewReader(s)
+		if err != nil {
+			return nil, err
+		}
+		s.gz = gz
+	} else if err := s.gz.Reset(s); err != nil {
+		return nil, err
+	}
+	s.gz.Multistream(false)
+	return tar.NewReader(s.gz), nil
+}
+
+// finish drains the current member, including the gzip trailer.
+func (s *segmentReader) finish() error {
+	_, err := io.Copy(io.Discard, s.gz)
+	s.raw = nil
+	return err
+}
+
+// ParsePublicKey parses a PEM-encoded RSA public key as found in /etc/apk/keys.
+func ParsePublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("public key: no PEM block found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("public key: %w", err)
+		}
+		rk, ok := k.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key: unsupported key type %T (RSA required)", k)
+		}
+		return rk, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("public key: unsupported PEM block %q", block.Type)
+	}
+}
+
+// VerifySignature checks the signature segment of the APK read from r against the trusted keys
+// (public key file name, e.g. "builder.rsa.pub", -> key). It returns the name of the key that
+// verified the control segment. Only signature and control are read; data is not checked.
+func VerifySignature(r io.Reader, keys map[string]*rsa.PublicKey) (string, error) {
+	sr := newSegmentReader(r)
+	if sr.isADB() {
+		return "", ErrADBFormat
+	}
+	tr, err := sr.Next(nil)
+	if err != nil {
+		return "", fmt.Errorf("signature segment: %w", err)
+	}
+	var sigs []Signature
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("signature segment: %w", err)
+		}
+		if !strings.HasPrefix(h.Name, ".SIGN.") {
+			return "", ErrNotSigned
+		}
+		sig, err := readSignatureEntry(h, tr)
+		if err != nil {
+			return "", fmt.Errorf("signature segment: %w", err)
+		}
+		sigs = append(sigs, sig)
+	}
+	var control bytes.Buffer
+	if _, err := sr.Next(&control); err != nil {
+		return "", fmt.Errorf("control segment: %w", err)
+	}
+	if err := sr.finish(); err != nil {
+		return "", fmt.Errorf("control segment: %w", err)
+	}
+
+	d1, d256 := sha1.Sum(control.Bytes()), sha256.Sum256(control.Bytes())
+	return checkSignatures(sigs, keys, map[crypto.Hash][]byte{crypto.SHA1: d1[:], crypto.SHA256: d256[:]})
+}
+
+// checkSignatures returns the name of the first trusted key with a valid signature over the
+// control segment, whose digests are given by hash.
+func checkSignatures(sigs []Signature, keys map[string]*rsa.PublicKey, digests map[crypto.Hash][]byte) (string, error) {
+	if len(sigs) == 0 {
+		return "", ErrNotSigned
+	}
+	var lastErr error
+	for _, s := range sigs {
+		pub, ok := keys[s.KeyName]
+		if !ok {
+			lastErr = fmt.Errorf("%w: %q", ErrUntrustedKey, s.KeyName)
+			continue
+		}
+		h, _, err := signatureHash(s.Type)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := rsa.VerifyPKCS1v15(pub, h, digests[h], s.Signature); err != nil {
+			lastErr = fmt.Errorf("%w: %s by %q: %v", ErrBadSignature, s.Type, s.KeyName, err)
+			continue
+		}
+		return s.KeyName, nil
+	}
+	return "", lastErr
+}
+
+// Verification failures, wrapped in the Problems of a *VerifyError (use errors.Is).
+var (
+	ErrNotSigned        = errors.New("package is not signed")
+	ErrUntrustedKey     = errors.New("no trusted key")
+	ErrBadSignature     = errors.New("invalid signature")
+	ErrDataHashMismatch = errors.New("datahash mismatch")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Checks reported in Problem.Check.
+const (
+	CheckSignature = "signature"
+	CheckDataHash  = "datahash"
+	CheckChecksum  = "checksum"
+)
+
+// Problem is one failed check.
+type Problem struct {
+	Check string // CheckSignature, CheckDataHash or CheckChecksum
+	Path  string // data file, for CheckChecksum
+	Err   error
+}
+
+func (p *Problem) Error() string {
+	if p.Path != "" {
+		return fmt.Sprintf("%s: %s: %v", p.Check, p.Path, p.Err)
+	}
+	return fmt.Sprintf("%s: %v", p.Check, p.Err)
+}
+
+func (p *Problem) Unwrap() error { return p.Err }
+
+// VerifyError is returned by Verify when the package was read but failed one or more checks.
+type VerifyError struct {
+	Problems []*Problem
+}
+
+func (e *VerifyError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return "verify: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As match any of the problems.
+func (e *VerifyError) Unwrap() []error {
+	errs := make([]error, len(e.Problems))
+	for i, p := range e.Problems {
+		errs[i] = p
+	}
+	return errs
+}
+
+// VerifyOptions controls which checks Verify runs.
+type VerifyOptions struct {
+	// Keys are the trusted public keys by file name (e.g. "builder.rsa.pub"), as in /etc/apk/keys.
+	Keys map[string]*rsa.PublicKey
+	// AllowUntrusted skips the signature check, like apk --allow-untrusted.
+	AllowUntrusted bool
+}
+
+// Verify reads the APK in r and checks, like apk-tools does on install, that the control segment
+// is signed by one of opts.Keys, that the data segment matches the datahash in .PKGINFO and that
+// every regular file and symlink matches its APK-TOOLS.checksum.SHA1 record (entries without one
+// are not checked). It returns the package and the name of the key that verified it. A package
+// that cannot be parsed returns a plain error; failed checks return a *VerifyError.
+func Verify(r io.Reader, opts VerifyOptions) (*Package, string, error) {
+	pkg, err := ReadAPK(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var (
+		problems []*Problem
+		keyName  string
+	)
+	if !opts.AllowUntrusted {
+		keyName, err = checkSignatures(pkg.Signatures, opts.Keys, pkg.controlDigests)
+		if err != nil {
+			problems = append(problems, &Problem{Check: CheckSignature, Err: err})
+		}
+	}
+	if err := pkg.VerifyDataHash(); err != nil {
+		problems = append(problems, &Problem{Check: CheckDataHash, Err: err})
+	}
+	for _, f := range pkg.Files {
+		if f.Checksum == "" || f.sum == "" {
+			continue
+		}
+		if !strings.EqualFold(f.Checksum, f.sum) {
+			problems = append(problems, &Problem{Check: CheckChecksum, Path: f.Name, Err: fmt.Errorf("%w: recorded %s, content is %s", ErrChecksumMismatch, f.Checksum, f.sum)})
+		}
+	}
+	if len(problems) > 0 {
+		return pkg, keyName, &VerifyError{Problems: problems}
+	}
+	return pkg, keyName, nil
+}
@@ -0,0 +1,133 @@
+package apk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rawSegments returns the compressed gzip members of the package data.
+func rawSegments(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	sr := newSegmentReader(bytes.NewReader(data))
+	var segs [][]byte
+	for {
+		var raw bytes.Buffer
+		if _, err := sr.Next(&raw); err == io.EOF {
+			return segs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := sr.finish(); err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, raw.Bytes())
+	}
+}
+
+// gzipBytes compresses b into a gzip member.
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// signedPackage returns a package of testTree signed by signer and the keys that trust it.
+func signedPackage(t *testing.T) ([]byte, map[string]*rsa.PublicKey) {
+	t.Helper()
+	signer := testSigner(t)
+	data := assembleBytes(t, testTree(), testSpec(), AssembleOptions{Signer: signer})
+	return data, map[string]*rsa.PublicKey{signer.KeyName(): &signer.Key.PublicKey}
+}
+
+// verifyProblems runs Verify and returns the problems it reported.
+func verifyProblems(t *testing.T, data []byte, opts VerifyOptions) []*Problem {
+	t.Helper()
+	_, _, err := Verify(bytes.NewReader(data), opts)
+	if err == nil {
+		t.Fatal("Verify succeeded")
+	}
+	var verr *VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a *VerifyError", err)
+	}
+	return verr.Problems
+}
+
+func TestVerify(t *testing.T) {
+	data, keys := signedPackage(t)
+	_, keyName, err := Verify(bytes.NewReader(data), VerifyOptions{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyName != "test.rsa.pub" {
+		t.Errorf("verified by %q, want test.rsa.pub", keyName)
+	}
+}
+
+func TestVerifyCorruptData(t *testing.T) {
+	data, keys := signedPackage(t)
+	// Change one byte of usr/bin/hello in the data segment, keeping the signed control segment.
+	raw, decoded := rawSegments(t, data), decodedSegments(t, data)
+	dataSeg := bytes.Replace(decoded[2], []byte("echo hello\n"), []byte("echo hellO\n"), 1)
+	if bytes.Equal(dataSeg, decoded[2]) {
+		t.Fatal("usr/bin/hello not found in the data segment")
+	}
+	corrupt := bytes.Join([][]byte{raw[0], raw[1], gzipBytes(t, dataSeg)}, nil)
+
+	problems := verifyProblems(t, corrupt, VerifyOptions{Keys: keys})
+	if len(problems) != 2 {
+		t.Fatalf("problems = %v, want datahash and checksum", problems)
+	}
+	if p := problems[0]; p.Check != CheckDataHash || !errors.Is(p, ErrDataHashMismatch) {
+		t.Errorf("problem 0 = %v, want ErrDataHashMismatch", p)
+	}
+	if p := problems[1]; p.Check != CheckChecksum || p.Path != "usr/bin/hello" || !errors.Is(p, ErrChecksumMismatch) {
+		t.Errorf("problem 1 = %v, want ErrChecksumMismatch for usr/bin/hello", p)
+	}
+	_, _, err := Verify(bytes.NewReader(corrupt), VerifyOptions{Keys: keys})
+	if !errors.Is(err, ErrDataHashMismatch) || !errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrBadSignature) {
+		t.Errorf("errors.Is does not match the problems of %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	data, keys := signedPackage(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := bytes.Join(rawSegments(t, data)[1:], nil)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		keys map[string]*rsa.PublicKey
+		want error
+	}{
+		{"no signature", unsigned, keys, ErrNotSigned},
+		{"untrusted key", data, map[string]*rsa.PublicKey{"other.rsa.pub": &other.PublicKey}, ErrUntrustedKey},
+		{"wrong key", data, map[string]*rsa.PublicKey{"test.rsa.pub": &other.PublicKey}, ErrBadSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			problems := verifyProblems(t, tc.data, VerifyOptions{Keys: tc.keys})
+			if len(problems) != 1 || problems[0].Check != CheckSignature || !errors.Is(problems[0], tc.want) {
+				t.Errorf("problems = %v, want one signature problem matching %v", problems, tc.want)
+			}
+		})
+	}
+	// The data and checksums of the unsigned package are still fine.
+	if _, _, err := Verify(bytes.NewReader(unsigned), VerifyOptions{AllowUntrusted: true}); err != nil {
+		t.Error(err)
+	}
+}
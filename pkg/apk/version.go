@@ -0,0 +1,151 @@
+package apk
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version tokens in the order apk-tools ranks them when two versions differ in shape: at the
+// first differing token type, the version that ends (or reaches a later type) first is older,
+// except that a pre-release suffix (_alpha, _beta, _pre, _rc) makes it older than the end.
+const (
+	tokDigit = iota
+	tokLetter
+	tokSuffix
+	tokSuffixNo
+	tokRevisionNo
+	tokEnd
+	tokInvalid
+)
+
+// versionSuffixes ranks the _suffix names: pre-releases below zero, post-releases above.
+var versionSuffixes = map[string]int64{
+	"alpha": -4, "beta": -3, "pre": -2, "rc": -1,
+	"cvs": 1, "svn": 2, "git": 3, "hg": 4, "p": 5,
+}
+
+type versionToken struct {
+	typ int
+	num int64
+	raw string // digits as written, for the leading-zero rule
+}
+
+// versionTokens splits an apk version (1.2.3a_rc1_p2~hash-r4) into tokens ending with tokEnd, or
+// tokInvalid where the version stops following the grammar.
+func versionTokens(v string) []versionToken {
+	var toks []versionToken
+	digits := func() string {
+		i := 0
+		for i < len(v) && v[i] >= '0' && v[i] <= '9' {
+			i++
+		}
+		d := v[:i]
+		v = v[i:]
+		return d
+	}
+	number := func(typ int) bool {
+		d := digits()
+		if d == "" {
+			return false
+		}
+		n, _ := strconv.ParseInt(d, 10, 64)
+		toks = append(toks, versionToken{typ: typ, num: n, raw: d})
+		return true
+	}
+	invalid := func() []versionToken { return append(toks, versionToken{typ: tokInvalid}) }
+
+	if !number(tokDigit) {
+		return invalid()
+	}
+	for len(v) > 0 && v[0] == '.' {
+		v = v[1:]
+		if !number(tokDigit) {
+			return invalid()
+		}
+	}
+	if len(v) > 0 && v[0] >= 'a' && v[0] <= 'z' {
+		toks = append(toks, versionToken{typ: tokLetter, num: int64(v[0])})
+		v = v[1:]
+	}
+	for len(v) > 0 && v[0] == '_' {
+		i := 1
+		for i < len(v) && v[i] >= 'a' && v[i] <= 'z' {
+			i++
+		}
+		rank, ok := versionSuffixes[v[1:i]]
+		if !ok {
+			return invalid()
+		}
+		toks = append(toks, versionToken{typ: tokSuffix, num: rank})
+		v = v[i:]
+		number(tokSuffixNo)
+	}
+	if len(v) > 0 && v[0] == '~' {
+		// A commit hash does not take part in the ordering.
+		v = strings.TrimLeft(v[1:], "0123456789abcdef")
+	}
+	if strings.HasPrefix(v, "-r") {
+		v = v[2:]
+		if !number(tokRevisionNo) {
+			return invalid()
+		}
+	}
+	if v != "" {
+		return invalid()
+	}
+	return append(toks, versionToken{typ: tokEnd})
+}
+
+// CompareVersions compares two apk versions (pkgver, e.g. 1.10-r0) the way apk-tools orders
+// them and returns -1, 0 or 1. Versions that do not follow the grammar compare as strings from
+// the first invalid part.
+func CompareVersions(a, b string) int {
+	at, bt := versionTokens(a), versionTokens(b)
+	i := 0
+	for ; i < len(at) && i < len(bt); i++ {
+		x, y := at[i], bt[i]
+		if x.typ != y.typ {
+			break
+		}
+		if x.typ == tokEnd || x.typ == tokInvalid {
+			if x.typ == tokInvalid {
+				return strings.Compare(a, b)
+			}
+			return 0
+		}
+		if c := compareToken(x, y, i == 0); c != 0 {
+			return c
+		}
+	}
+	x, y := at[i], bt[i]
+	if x.typ == tokInvalid || y.typ == tokInvalid {
+		return strings.Compare(a, b)
+	}
+	// Same leading tokens: the longer version is newer unless it continues with a pre-release.
+	switch {
+	case x.typ == tokSuffix && x.num < 0:
+		return -1
+	case y.typ == tokSuffix && y.num < 0:
+		return 1
+	case x.typ > y.typ:
+		return -1
+	case x.typ < y.typ:
+		return 1
+	}
+	return 0
+}
+
+// compareToken compares two tokens of the same type. Digits after the first component that have
+// a leading zero compare as strings (1.01 < 1.1), as in apk-tools.
+func compareToken(x, y versionToken, first bool) int {
+	if x.typ == tokDigit && !first && (strings.HasPrefix(x.raw, "0") || strings.HasPrefix(y.raw, "0")) {
+		return strings.Compare(x.raw, y.raw)
+	}
+	switch {
+	case x.num < y.num:
+		return -1
+	case x.num > y.num:
+		return 1
+	}
+	return 0
+}
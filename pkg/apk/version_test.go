@@ -0,0 +1,33 @@
+package apk
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0-r0", "1.0-r0", 0},
+		{"1.9-r0", "1.10-r0", -1},
+		{"1.10-r0", "1.9-r0", 1},
+		{"1.0-r1", "1.0-r10", -1},
+		{"1.0-r2", "1.0-r10", -1},
+		{"1.0", "1.0-r1", -1},
+		{"1.0", "1.0.1", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.0_rc1", "1.0", -1},
+		{"1.0_alpha2", "1.0_beta1", -1},
+		{"1.0_rc1", "1.0_rc2", -1},
+		{"1.0_p1", "1.0", 1},
+		{"1.0_p1", "1.0.1", -1},
+		{"1.01", "1.1", -1},
+		{"2.0~abc123-r0", "2.0-r0", 0},
+		{"10", "9", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
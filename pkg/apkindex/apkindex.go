@@ -0,0 +1,188 @@
+// Package apkindex builds APKINDEX.tar.gz for a directory of .apk files, the index apk-tools
+// downloads from a repository (same format as `apk index`).
+//
+// APKINDEX.tar.gz = [signature tgz +] tgz with DESCRIPTION and APKINDEX. APKINDEX holds one
+// block of "X:value" lines per package, separated by blank lines; C: is "Q1" + base64 of the
+// SHA1 of the package's control segment.
+package apkindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tuananh/apkbuild/pkg/apk"
+)
+
+// FileName is the index file name apk-tools looks for in each <arch>/ directory of a repository.
+const FileName = "APKINDEX.tar.gz"
+
+// Entry is one package in the index.
+type Entry struct {
+	*apk.PKGInfo
+	// Checksum is the SHA1 of the control segment.
+	Checksum []byte
+	// FileSize is the size of the .apk file in bytes.
+	FileSize int64
+}
+
+// ReadEntry reads the index entry for the .apk file at path.
+func ReadEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pi, sum, err := apk.ReadPKGInfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return &Entry{PKGInfo: pi, Checksum: sum, FileSize: info.Size()}, nil
+}
+
+// ReadDir reads the index entries for all *.apk files in dir, sorted by name, then pkgver
+// in apk version order.
+func ReadDir(dir string) ([]*Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(paths))
+	for _, p := range paths {
+		e, err := ReadEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].PkgName != entries[j].PkgName {
+			return entries[i].PkgName < entries[j].PkgName
+		}
+		return apk.CompareVersions(entries[i].PkgVer, entries[j].PkgVer) < 0
+	})
+	return entries, nil
+}
+
+// Options controls index output.
+type Options struct {
+	// Description is written to DESCRIPTION (e.g. "v3.23 main").
+	Description string
+	// Signer, if set, prepends a signature segment over the index tgz, as abuild-sign does.
+	Signer apk.Signer
+	// SignatureType is apk.SignatureRSA (default) or apk.SignatureRSA256.
+	SignatureType string
+}
+
+// Write writes APKINDEX.tar.gz for entries to w.
+func Write(w io.Writer, entries []*Entry, opts Options) error {
+	var index bytes.Buffer
+	for _, e := range entries {
+		writeEntry(&index, e)
+	}
+
+	var tgz bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"DESCRIPTION", []byte(opts.Description)},
+		{"APKINDEX", index.Bytes()},
+	}
+	for _, f := range files {
+		h := &tar.Header{
+			Name:   f.name,
+			Mode:   0o644,
+			Size:   int64(len(f.data)),
+			Uname:  "root",
+			Gname:  "root",
+			Format: tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if opts.Signer != nil {
+		sig, err := apk.SignatureSegment(opts.Signer, opts.SignatureType, tgz.Bytes())
+		if err != nil {
+			return fmt.Errorf("sign index: %w", err)
+		}
+		if _, err := w.Write(sig); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(tgz.Bytes())
+	return err
+}
+
+// WriteDir indexes the *.apk files in dir and writes dir/APKINDEX.tar.gz.
+func WriteDir(dir string, opts Options) error {
+	entries, err := ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, entries, opts); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName), buf.Bytes(), 0o644)
+}
+
+// writeEntry writes one package block in the field order apk-tools uses.
+func writeEntry(b *bytes.Buffer, e *Entry) {
+	field := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(b, "%s:%s\n", k, v)
+		}
+	}
+	field("C", "Q1"+base64.StdEncoding.EncodeToString(e.Checksum))
+	field("P", e.PkgName)
+	field("V", e.PkgVer)
+	field("A", e.Arch)
+	field("S", strconv.FormatInt(e.FileSize, 10))
+	field("I", strconv.FormatInt(e.Size, 10))
+	field("T", e.PkgDesc)
+	field("U", e.URL)
+	field("L", e.License)
+	field("o", e.Origin)
+	field("m", e.Maintainer)
+	if e.BuildDate > 0 {
+		field("t", strconv.FormatInt(e.BuildDate, 10))
+	}
+	field("c", e.Commit)
+	if e.ProviderPriority > 0 {
+		field("k", strconv.Itoa(e.ProviderPriority))
+	}
+	field("D", strings.Join(e.Depends, " "))
+	field("p", strings.Join(e.Provides, " "))
+	field("i", strings.Join(e.InstallIf, " "))
+	field("r", strings.Join(e.Replaces, " "))
+	if e.ReplacesPriority > 0 {
+		field("q", strconv.Itoa(e.ReplacesPriority))
+	}
+	b.WriteString("\n")
+}
@@ -0,0 +1,245 @@
+package apkindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tuananh/apkbuild/pkg/apk"
+	"github.com/tuananh/apkbuild/pkg/spec"
+)
+
+var testEpoch = time.Unix(1700000000, 0).UTC()
+
+// testRepo assembles three packages into a temporary directory and returns it.
+func testRepo(t *testing.T, signer apk.Signer) string {
+	t.Helper()
+	dir := t.TempDir()
+	tree := fstest.MapFS{
+		"usr/share/hello/a.txt": {Data: []byte("a\n"), Mode: 0o644, ModTime: testEpoch},
+	}
+	pkgs := []*spec.Spec{
+		{Name: "zed", Version: "1.0", Description: "last", License: "MIT"},
+		{Name: "hello", Version: "1.10", Epoch: 1, Description: "newer", License: "MIT", URL: "https://example.com",
+			Package:      spec.Package{Origin: "hello-src", Maintainer: "Jane <jane@example.com>"},
+			Dependencies: spec.Dependencies{Runtime: []string{"musl", "so:libz.so.1"}, Provides: []string{"greeter=1.10"}}},
+		{Name: "hello", Version: "1.9", Description: "older", License: "MIT"},
+	}
+	for _, s := range pkgs {
+		s.Dependencies.Auto.Disabled = true
+		var buf bytes.Buffer
+		opts := apk.AssembleOptions{Arch: apk.ArchNoarch, SourceDateEpoch: &testEpoch, Signer: signer}
+		if err := apk.Assemble(&buf, tree, s, opts); err != nil {
+			t.Fatal(err)
+		}
+		name := s.Name + "-" + s.Version + "-r" + strconv.Itoa(s.Epoch) + ".apk"
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// testSigner returns a signer with a new key.
+func testSigner(t *testing.T) *apk.RSASigner {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := apk.NewRSASigner("test", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// segments splits data into its gzip members.
+func segments(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var segs [][]byte
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		start := len(data) - r.Len()
+		// bytes.Reader is an io.ByteReader, so gzip does not read past the member.
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz.Multistream(false)
+		if _, err := io.Copy(io.Discard, gz); err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, data[start:len(data)-r.Len()])
+	}
+	return segs
+}
+
+// readIndex returns the files of the index tgz seg.
+func readIndex(t *testing.T, seg []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(seg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(b)
+	}
+	return files
+}
+
+// controlChecksum returns the APKINDEX checksum of the package at path: the SHA1 of its control
+// segment, the first gzip member or the second one when signed.
+func controlChecksum(t *testing.T, path string, signed bool) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs := segments(t, data)
+	control := segs[0]
+	if signed {
+		control = segs[1]
+	}
+	sum := sha1.Sum(control)
+	return "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestWriteDir(t *testing.T) {
+	dir := testRepo(t, nil)
+	if err := WriteDir(dir, Options{Description: "v3.23 main"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs := segments(t, data)
+	if len(segs) != 1 {
+		t.Fatalf("unsigned index has %d segments, want 1", len(segs))
+	}
+	files := readIndex(t, segs[0])
+	if files["DESCRIPTION"] != "v3.23 main" {
+		t.Errorf("DESCRIPTION = %q", files["DESCRIPTION"])
+	}
+
+	size := func(name string) string {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strconv.FormatInt(info.Size(), 10)
+	}
+	sum := func(name string) string { return controlChecksum(t, filepath.Join(dir, name), false) }
+	// Sorted by name then version (1.9 before 1.10), fields in apk-tools order.
+	want := strings.Join([]string{
+		"C:" + sum("hello-1.9-r0.apk"),
+		"P:hello",
+		"V:1.9-r0",
+		"A:noarch",
+		"S:" + size("hello-1.9-r0.apk"),
+		"I:2",
+		"T:older",
+		"L:MIT",
+		"o:hello",
+		"t:1700000000",
+		"",
+		"C:" + sum("hello-1.10-r1.apk"),
+		"P:hello",
+		"V:1.10-r1",
+		"A:noarch",
+		"S:" + size("hello-1.10-r1.apk"),
+		"I:2",
+		"T:newer",
+		"U:https://example.com",
+		"L:MIT",
+		"o:hello-src",
+		"m:Jane <jane@example.com>",
+		"t:1700000000",
+		"D:musl so:libz.so.1",
+		"p:greeter=1.10",
+		"",
+		"C:" + sum("zed-1.0-r0.apk"),
+		"P:zed",
+		"V:1.0-r0",
+		"A:noarch",
+		"S:" + size("zed-1.0-r0.apk"),
+		"I:2",
+		"T:last",
+		"L:MIT",
+		"o:zed",
+		"t:1700000000",
+		"",
+	}, "\n") + "\n"
+	if got := files["APKINDEX"]; got != want {
+		t.Errorf("APKINDEX:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteDirSigned(t *testing.T) {
+	signer := testSigner(t)
+	dir := testRepo(t, signer)
+	if err := WriteDir(dir, Options{Signer: signer, SignatureType: apk.SignatureRSA256}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*rsa.PublicKey{signer.KeyName(): &signer.Key.PublicKey}
+	if _, err := apk.VerifySignature(bytes.NewReader(data), keys); err != nil {
+		t.Fatalf("index signature: %v", err)
+	}
+	segs := segments(t, data)
+	if len(segs) != 2 {
+		t.Fatalf("signed index has %d segments, want 2", len(segs))
+	}
+	// The checksums of signed packages cover the control segment, not the signature.
+	index := readIndex(t, segs[1])["APKINDEX"]
+	for _, name := range []string{"hello-1.9-r0.apk", "hello-1.10-r1.apk", "zed-1.0-r0.apk"} {
+		if sum := controlChecksum(t, filepath.Join(dir, name), true); !strings.Contains(index, "C:"+sum+"\n") {
+			t.Errorf("index has no C:%s for %s:\n%s", sum, name, index)
+		}
+	}
+}
+
+func TestReadDirSkipsOtherFiles(t *testing.T) {
+	dir := testRepo(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("old index"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d entries, want 3", len(entries))
+	}
+}
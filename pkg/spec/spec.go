@@ -10,12 +10,30 @@ type Spec struct {
 	URL          string            `yaml:"url,omitempty" json:"url,omitempty"`
 	License      string            `yaml:"license,omitempty" json:"license,omitempty"`
 	Description  string            `yaml:"description" json:"description,omitempty"`
+	Arch         string            `yaml:"arch,omitempty" json:"arch,omitempty"` // "noarch" for architecture-independent packages; default is the build platform arch
 	Copyright    []Copyright       `yaml:"copyright,omitempty" json:"copyright,omitempty"`
+	Package      Package           `yaml:"package,omitempty" json:"package,omitempty"` // extra .PKGINFO metadata (origin, maintainer, ...)
+	Scripts      Scripts           `yaml:"scripts,omitempty" json:"scripts,omitempty"` // install scripts packed into the control segment
 	Dependencies Dependencies      `yaml:"dependencies,omitempty" json:"dependencies,omitempty"`
 	Environment  Environment       `yaml:"environment,omitempty" json:"environment,omitempty"`
 	Sources      map[string]Source `yaml:"sources,omitempty" json:"sources,omitempty"`
+	Secrets      map[string]Secret `yaml:"secrets,omitempty" json:"secrets,omitempty"` // BuildKit secret id -> how steps listing it see it
 	Pipeline     []PipelineStep    `yaml:"pipeline" json:"pipeline"`
-	Build        Build             `yaml:"build,omitempty" json:"build,omitempty"` // optional install_dir, source_dir
+	Subpackages  []Subpackage      `yaml:"subpackages,omitempty" json:"subpackages,omitempty"` // extra packages split from the main destdir
+	Build        Build             `yaml:"build,omitempty" json:"build,omitempty"`             // optional install_dir, source_dir
+	Cache        []string          `yaml:"cache,omitempty" json:"cache,omitempty"`             // BuildKit cache mounts for every step: apk, ccache, go-build, go-mod, cargo
+}
+
+// Subpackage is an additional APK built from the same sources. Its pipeline runs after the main
+// pipeline and moves (or installs) files into ${{targets.subpkgdir}}, e.g. with uses: split/dev.
+type Subpackage struct {
+	Name         string         `yaml:"name" json:"name"`
+	Description  string         `yaml:"description,omitempty" json:"description,omitempty"` // default: main description
+	Arch         string         `yaml:"arch,omitempty" json:"arch,omitempty"`               // "noarch" for e.g. -doc
+	Dependencies Dependencies   `yaml:"dependencies,omitempty" json:"dependencies,omitempty"`
+	Scripts      Scripts        `yaml:"scripts,omitempty" json:"scripts,omitempty"`
+	Triggers     []string       `yaml:"triggers,omitempty" json:"triggers,omitempty"` // paths for scripts.trigger
+	Pipeline     []PipelineStep `yaml:"pipeline,omitempty" json:"pipeline,omitempty"`
 }
 
 // Copyright entry (e.g. attestation + license).
@@ -24,9 +42,74 @@ type Copyright struct {
 	License     string `yaml:"license" json:"license"`
 }
 
+// Package holds .PKGINFO metadata beyond name/version/description.
+type Package struct {
+	Origin     string   `yaml:"origin,omitempty" json:"origin,omitempty"` // source package name (default: name)
+	Maintainer string   `yaml:"maintainer,omitempty" json:"maintainer,omitempty"`
+	Packager   string   `yaml:"packager,omitempty" json:"packager,omitempty"`
+	Commit     string   `yaml:"commit,omitempty" json:"commit,omitempty"`     // commit of the packaging repository
+	Triggers   []string `yaml:"triggers,omitempty" json:"triggers,omitempty"` // directories (globs) that fire the package trigger
+	Format     string   `yaml:"format,omitempty" json:"format,omitempty"`     // "v2" (default, apk-tools 2) or "v3" (apk-tools 3 ADB)
+}
+
+// Scripts are the apk install scripts (.pre-install, .post-install, ..., .trigger).
+type Scripts struct {
+	PreInstall    Script `yaml:"pre_install,omitempty" json:"pre_install,omitempty"`
+	PostInstall   Script `yaml:"post_install,omitempty" json:"post_install,omitempty"`
+	PreUpgrade    Script `yaml:"pre_upgrade,omitempty" json:"pre_upgrade,omitempty"`
+	PostUpgrade   Script `yaml:"post_upgrade,omitempty" json:"post_upgrade,omitempty"`
+	PreDeinstall  Script `yaml:"pre_deinstall,omitempty" json:"pre_deinstall,omitempty"`
+	PostDeinstall Script `yaml:"post_deinstall,omitempty" json:"post_deinstall,omitempty"`
+	Trigger       Script `yaml:"trigger,omitempty" json:"trigger,omitempty"` // runs when files change under package.triggers
+}
+
+// Script is an install script: inline shell, or a file in the build context.
+// In YAML, a script can be a string (inline) or an object: { run?, path? }
+type Script struct {
+	Run  string `yaml:"run,omitempty" json:"run,omitempty"`
+	Path string `yaml:"path,omitempty" json:"path,omitempty"` // relative to the build context
+}
+
+// UnmarshalYAML supports short form (string = inline script) or long form (object with run or path).
+func (sc *Script) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		sc.Run = s
+		return nil
+	}
+	var m struct {
+		Run  string `yaml:"run"`
+		Path string `yaml:"path"`
+	}
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	sc.Run = m.Run
+	sc.Path = m.Path
+	return nil
+}
+
+// IsZero reports whether no script is set.
+func (sc Script) IsZero() bool { return sc.Run == "" && sc.Path == "" }
+
 // Dependencies declares package dependencies (runtime, etc.) for the produced APK.
+// Entries are apk dependency atoms: name, name>=1.2, !conflict, so:libfoo.so.1, cmd:foo, pc:foo.
 type Dependencies struct {
-	Runtime []string `yaml:"runtime,omitempty" json:"runtime,omitempty"`
+	Runtime          []string `yaml:"runtime,omitempty" json:"runtime,omitempty"`
+	Conflicts        []string `yaml:"conflicts,omitempty" json:"conflicts,omitempty"` // written as depend = !name
+	Provides         []string `yaml:"provides,omitempty" json:"provides,omitempty"`   // name or name=version
+	Replaces         []string `yaml:"replaces,omitempty" json:"replaces,omitempty"`
+	InstallIf        []string `yaml:"install_if,omitempty" json:"install_if,omitempty"`
+	ProviderPriority int      `yaml:"provider_priority,omitempty" json:"provider_priority,omitempty"`
+	ReplacesPriority int      `yaml:"replaces_priority,omitempty" json:"replaces_priority,omitempty"`
+	Auto             AutoDeps `yaml:"auto,omitempty" json:"auto,omitempty"` // so:/cmd:/pc: detection from the packaged files
+}
+
+// AutoDeps controls automatic dependency and provider detection. By default ELF DT_NEEDED/DT_SONAME,
+// executables in bin directories and pkg-config files add so:, cmd: and pc: entries to .PKGINFO.
+type AutoDeps struct {
+	Disabled bool     `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Ignore   []string `yaml:"ignore,omitempty" json:"ignore,omitempty"` // glob patterns on generated names, e.g. "so:libfoo.so.*", "cmd:*"
 }
 
 // Environment defines the build environment (repositories + packages to install).
@@ -40,27 +123,62 @@ type EnvironmentContents struct {
 	Packages     []string `yaml:"packages,omitempty" json:"packages,omitempty"`
 }
 
-// Source defines a single source (e.g. from build context).
+// Source defines a single source (e.g. from build context), placed at /src/<key>.
 type Source struct {
 	Context *SourceContext `yaml:"context,omitempty" json:"context,omitempty"`
+	HTTP    *HTTPSource    `yaml:"http,omitempty" json:"http,omitempty"`
+}
+
+// HTTPSource is a file downloaded by BuildKit and verified against its checksum (one of sha256
+// and sha512 is required), optionally extracted as a tarball.
+type HTTPSource struct {
+	URI             string `yaml:"uri" json:"uri"`
+	SHA256          string `yaml:"sha256,omitempty" json:"sha256,omitempty"`
+	SHA512          string `yaml:"sha512,omitempty" json:"sha512,omitempty"`
+	Filename        string `yaml:"filename,omitempty" json:"filename,omitempty"` // default: last path element of the URI
+	Extract         bool   `yaml:"extract,omitempty" json:"extract,omitempty"`   // extract with tar instead of copying the file
+	StripComponents int    `yaml:"strip_components,omitempty" json:"strip_components,omitempty"`
 }
 
-// SourceContext uses the Docker build context.
+// SourceContext uses a named build context (--build-context name=dir, docker-image://, git
+// URL, ...), filtered with include/exclude patterns (.dockerignore syntax).
 type SourceContext struct {
-	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	Name    string   `yaml:"name,omitempty" json:"name,omitempty"` // default: the source's key
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
 }
 
-// Build holds optional install prefix and source subdir (pipeline is top-level).
+// Build holds optional install prefix, source subdir and reproducibility settings (pipeline is top-level).
 type Build struct {
 	InstallDir string `yaml:"install_dir,omitempty" json:"install_dir,omitempty"`
 	SourceDir  string `yaml:"source_dir,omitempty" json:"source_dir,omitempty"`
+	// SourceDateEpoch (Unix seconds) enables reproducible output; the SOURCE_DATE_EPOCH build arg overrides it.
+	SourceDateEpoch *int64 `yaml:"source_date_epoch,omitempty" json:"source_date_epoch,omitempty"`
+	// Cross runs the pipeline on the build platform and cross-compiles for the target platform with
+	// clang, instead of running it under emulation of the target.
+	Cross bool `yaml:"cross,omitempty" json:"cross,omitempty"`
 }
 
 // PipelineStep is one step in the build pipeline: either "uses" (predefined) or "run" (inline).
 type PipelineStep struct {
-	Uses string                 `yaml:"uses,omitempty" json:"uses,omitempty"`
-	With map[string]interface{} `yaml:"with,omitempty" json:"with,omitempty"`
-	Run  string                 `yaml:"run,omitempty" json:"run,omitempty"`
+	Uses    string                 `yaml:"uses,omitempty" json:"uses,omitempty"`
+	With    map[string]interface{} `yaml:"with,omitempty" json:"with,omitempty"`
+	Run     string                 `yaml:"run,omitempty" json:"run,omitempty"`
+	Secrets []string               `yaml:"secrets,omitempty" json:"secrets,omitempty"` // ids from the spec's secrets: mounted in this step
+	SSH     bool                   `yaml:"ssh,omitempty" json:"ssh,omitempty"`         // forward the default SSH agent (--ssh default)
+	Network bool                   `yaml:"network,omitempty" json:"network,omitempty"` // allow network access (steps run without it unless they fetch sources)
+	// Each step runs in a new shell from /: WorkingDirectory and Environment replace a cd or an
+	// export in an earlier step, which no longer carry over.
+	WorkingDirectory string            `yaml:"working_directory,omitempty" json:"working_directory,omitempty"`
+	Environment      map[string]string `yaml:"environment,omitempty" json:"environment,omitempty"`
+}
+
+// Secret exposes a BuildKit secret (--secret id=<key>) to the steps that list it. Without env
+// or file it is mounted at /run/secrets/<id>; it never ends up in the spec or the build result.
+type Secret struct {
+	Env      string `yaml:"env,omitempty" json:"env,omitempty"`   // environment variable holding the value
+	File     string `yaml:"file,omitempty" json:"file,omitempty"` // absolute path of the file holding the value
+	Optional bool   `yaml:"optional,omitempty" json:"optional,omitempty"`
 }
 
 // Load parses YAML bytes into Spec.